@@ -0,0 +1,175 @@
+// Package benchmarks contains representative Marshal corpora and benchmarks that exercise rmarsh with them. The micro
+// benchmarks alongside the Parser and Generator only cover single tokens; these cover the shapes of data found in real
+// Ruby deployments, so that performance regressions show up before they ship.
+//
+// The corpora are built with the Generator rather than checked in, so they don't need Ruby to (re)create. Run the
+// benchmarks with CPU and allocation profiles like so:
+//
+//	go test -run - -bench . -benchmem -cpuprofile cpu.out -memprofile mem.out ./benchmarks
+//
+// The corpora are read with the Parser, Validate and NewIndex. The Parser doesn't understand every type of value yet,
+// so its benchmarks skip the corpora it can't read.
+package benchmarks
+
+import (
+	"bytes"
+	"strconv"
+
+	"github.com/samcday/rmarsh"
+)
+
+// A Corpus is a named, complete Marshal stream.
+type Corpus struct {
+	Name  string
+	Data  []byte
+	Write func(*rmarsh.Generator) error // Writes Data to a Generator.
+}
+
+// Corpora returns every benchmark corpus.
+func Corpora() ([]Corpus, error) {
+	corpora := []Corpus{
+		{Name: "session", Write: Session},
+		{Name: "ar_cache_entry", Write: ARCacheEntry},
+		{Name: "deep_nesting", Write: DeepNesting},
+		{Name: "symbol_heavy", Write: SymbolHeavy},
+		{Name: "string_heavy", Write: StringHeavy},
+	}
+
+	var buf bytes.Buffer
+	gen := rmarsh.NewGenerator(&buf)
+	for i := range corpora {
+		buf.Reset()
+		gen.Reset(nil)
+		if err := corpora[i].Write(gen); err != nil {
+			return nil, err
+		}
+		corpora[i].Data = append([]byte(nil), buf.Bytes()...)
+	}
+	return corpora, nil
+}
+
+// writer wraps a Generator and remembers the first error it returns, so corpora can be written without checking
+// every call.
+type writer struct {
+	gen *rmarsh.Generator
+	err error
+}
+
+func (w *writer) do(err error) {
+	if w.err == nil {
+		w.err = err
+	}
+}
+
+// str writes a UTF-8 String, as Ruby does for string literals.
+func (w *writer) str(s string) {
+	w.do(w.gen.StartIVar(1))
+	w.do(w.gen.String(s))
+	w.do(w.gen.Symbol("E"))
+	w.do(w.gen.Bool(true))
+	w.do(w.gen.EndIVar())
+}
+
+// Session writes a Rails style cookie session: a small hash of string keys holding a mix of values.
+func Session(gen *rmarsh.Generator) error {
+	w := &writer{gen: gen}
+	w.do(gen.StartHash(5))
+	w.str("session_id")
+	w.str("3f2a0c4c9d6b4e1f8a7b5c3d2e1f0a9b")
+	w.str("_csrf_token")
+	w.str("pL0d3eSdXyaQy3wAq1ZpXwGkNKm6c2JQbVfNzT0hRXo=")
+	w.str("user_id")
+	w.do(gen.Fixnum(1234567))
+	w.str("warden.user.user.key")
+	w.do(gen.StartArray(2))
+	w.do(gen.StartArray(1))
+	w.do(gen.Fixnum(1234567))
+	w.do(gen.EndArray())
+	w.str("$2a$10$KssILxWNR6k62B7yiX0GAe")
+	w.do(gen.EndArray())
+	w.str("flash")
+	w.do(gen.StartHash(2))
+	w.str("discard")
+	w.do(gen.StartArray(0))
+	w.do(gen.EndArray())
+	w.str("flashes")
+	w.do(gen.StartHash(1))
+	w.str("notice")
+	w.str("Signed in successfully.")
+	w.do(gen.EndHash())
+	w.do(gen.EndHash())
+	w.do(gen.EndHash())
+	return w.err
+}
+
+// ARCacheEntry writes an ActiveSupport cache entry holding a list of 100 ActiveRecord-like objects.
+func ARCacheEntry(gen *rmarsh.Generator) error {
+	w := &writer{gen: gen}
+	w.do(gen.StartObject("ActiveSupport::Cache::Entry", 3))
+	w.do(gen.Symbol("@value"))
+	w.do(gen.StartArray(100))
+	for i := 0; i < 100; i++ {
+		w.do(gen.StartObject("User", 2))
+		w.do(gen.Symbol("@attributes"))
+		w.do(gen.StartHash(6))
+		w.str("id")
+		w.do(gen.Fixnum(int64(i)))
+		w.str("email")
+		w.str("user" + strconv.Itoa(i) + "@example.com")
+		w.str("name")
+		w.str("User Number " + strconv.Itoa(i))
+		w.str("admin")
+		w.do(gen.Bool(i%10 == 0))
+		w.str("created_at")
+		w.do(gen.Float(1.5e9 + float64(i)))
+		w.str("deleted_at")
+		w.do(gen.Nil())
+		w.do(gen.EndHash())
+		w.do(gen.Symbol("@new_record"))
+		w.do(gen.Bool(false))
+		w.do(gen.EndObject())
+	}
+	w.do(gen.EndArray())
+	w.do(gen.Symbol("@created_at"))
+	w.do(gen.Float(1.5e9))
+	w.do(gen.Symbol("@expires_in"))
+	w.do(gen.Nil())
+	w.do(gen.EndObject())
+	return w.err
+}
+
+// DeepNesting writes 1000 single element arrays nested within each other.
+func DeepNesting(gen *rmarsh.Generator) error {
+	const depth = 1000
+	w := &writer{gen: gen}
+	for i := 0; i < depth; i++ {
+		w.do(gen.StartArray(1))
+	}
+	w.do(gen.Nil())
+	for i := 0; i < depth; i++ {
+		w.do(gen.EndArray())
+	}
+	return w.err
+}
+
+// SymbolHeavy writes an array of 10,000 symbols drawn from 1,000 distinct names, so most are symlinks.
+func SymbolHeavy(gen *rmarsh.Generator) error {
+	w := &writer{gen: gen}
+	w.do(gen.StartArray(10000))
+	for i := 0; i < 10000; i++ {
+		w.do(gen.Symbol("symbol_" + strconv.Itoa(i%1000)))
+	}
+	w.do(gen.EndArray())
+	return w.err
+}
+
+// StringHeavy writes an array of 10,000 UTF-8 strings of varying length.
+func StringHeavy(gen *rmarsh.Generator) error {
+	w := &writer{gen: gen}
+	w.do(gen.StartArray(10000))
+	for i := 0; i < 10000; i++ {
+		w.str(strconv.Itoa(i) + " " + string(bytes.Repeat([]byte("lorem ipsum "), i%32)))
+	}
+	w.do(gen.EndArray())
+	return w.err
+}
@@ -0,0 +1,113 @@
+package benchmarks_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/samcday/rmarsh"
+	"github.com/samcday/rmarsh/benchmarks"
+)
+
+func corpora(tb testing.TB) []benchmarks.Corpus {
+	c, err := benchmarks.Corpora()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return c
+}
+
+func TestCorporaValid(t *testing.T) {
+	for _, c := range corpora(t) {
+		report, err := rmarsh.Validate(bytes.NewReader(c.Data), rmarsh.ValidateLimits{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !report.Valid() {
+			t.Errorf("Corpus %s is invalid: %v", c.Name, report.Findings)
+		}
+	}
+}
+
+// readAll reads every token of a stream from p.
+func readAll(p *rmarsh.Parser) error {
+	for {
+		tok, _, _, err := p.Read()
+		if err != nil || tok == rmarsh.TokenEOF {
+			return err
+		}
+	}
+}
+
+func BenchmarkGenerate(b *testing.B) {
+	for _, c := range corpora(b) {
+		c := c
+		b.Run(c.Name, func(b *testing.B) {
+			gen := rmarsh.NewGenerator(ioutil.Discard)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				gen.Reset(nil)
+				if err := c.Write(gen); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkParse(b *testing.B) {
+	for _, c := range corpora(b) {
+		c := c
+		b.Run(c.Name, func(b *testing.B) {
+			r := bytes.NewReader(c.Data)
+			p := rmarsh.NewParser(r)
+			if err := readAll(p); err != nil {
+				b.Skipf("Parser can't read corpus: %s", err)
+			}
+			b.SetBytes(int64(len(c.Data)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				r.Reset(c.Data)
+				p.Reset(r)
+				if err := readAll(p); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkValidate(b *testing.B) {
+	for _, c := range corpora(b) {
+		c := c
+		b.Run(c.Name, func(b *testing.B) {
+			r := bytes.NewReader(c.Data)
+			b.SetBytes(int64(len(c.Data)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				r.Reset(c.Data)
+				if _, err := rmarsh.Validate(r, rmarsh.ValidateLimits{}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkIndex(b *testing.B) {
+	for _, c := range corpora(b) {
+		c := c
+		b.Run(c.Name, func(b *testing.B) {
+			r := bytes.NewReader(c.Data)
+			b.SetBytes(int64(len(c.Data)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				r.Reset(c.Data)
+				if _, err := rmarsh.NewIndex(r); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package rmarsh
+
+import (
+	"bytes"
+	"compress/zlib"
+	"io"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+)
+
+// Memcached item flags used by the Dalli Ruby client to describe how a stored value was encoded.
+const (
+	DalliFlagSerialized = 0x1 // The value is a Marshal stream.
+	DalliFlagCompressed = 0x2 // The value was deflated with Zlib::Deflate.deflate.
+)
+
+// DalliCompressionMinSize is the default size (in bytes) from which Dalli compresses values.
+const DalliCompressionMinSize = 4 * 1024
+
+// DalliEncode prepares a payload for storage in memcached in the same way the Dalli client does, returning the value
+// bytes and the item flags that must be stored alongside them.
+// If raw is false the payload must be a complete Marshal stream (as written by a Generator), otherwise it is stored as
+// a plain string (the equivalent of Dalli's :raw option). Payloads of compressMin bytes or more are deflated. Pass a
+// compressMin of 0 to disable compression.
+func DalliEncode(payload []byte, raw bool, compressMin int) ([]byte, uint32, error) {
+	var flags uint32
+	if !raw {
+		flags |= DalliFlagSerialized
+	}
+
+	if compressMin <= 0 || len(payload) < compressMin {
+		return payload, flags, nil
+	}
+
+	var b bytes.Buffer
+	zw := zlib.NewWriter(&b)
+	if _, err := zw.Write(payload); err != nil {
+		return nil, 0, errors.Wrap(err, "compress")
+	}
+	if err := zw.Close(); err != nil {
+		return nil, 0, errors.Wrap(err, "compress")
+	}
+	return b.Bytes(), flags | DalliFlagCompressed, nil
+}
+
+// DalliDecode reverses DalliEncode. It inflates the value if the flags indicate it was compressed, and reports whether
+// the resulting payload is a Marshal stream that should be handed to a Parser, or a raw string.
+func DalliDecode(value []byte, flags uint32) (payload []byte, serialized bool, err error) {
+	payload = value
+	if flags&DalliFlagCompressed != 0 {
+		var zr io.ReadCloser
+		if zr, err = zlib.NewReader(bytes.NewReader(value)); err != nil {
+			return nil, false, errors.Wrap(err, "decompress")
+		}
+		if payload, err = ioutil.ReadAll(zr); err != nil {
+			return nil, false, errors.Wrap(err, "decompress")
+		}
+	}
+	return payload, flags&DalliFlagSerialized != 0, nil
+}
+
+// IsRedisStoreMarshal inspects a value read from Redis that was written by the redis-store family of Ruby gems. These
+// store Marshal.dump output verbatim unless the :raw option was used, and record no flags to tell the two apart. So, we
+// sniff the Marshal 4.8 magic header to decide whether the payload should be handed to a Parser.
+// Values written for redis-store need no special encoding: write the Generator output (or raw string) as is.
+func IsRedisStoreMarshal(value []byte) (serialized bool) {
+	return len(value) > len(magic) && bytes.Equal(value[:len(magic)], magic)
+}
@@ -0,0 +1,68 @@
+package rmarsh_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/samcday/rmarsh"
+)
+
+func TestDalliRoundTrip(t *testing.T) {
+	b := new(bytes.Buffer)
+	gen := rmarsh.NewGenerator(b)
+	if err := gen.String(strings.Repeat("test", 100)); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		raw         bool
+		compressMin int
+		expFlags    uint32
+	}{
+		{false, 0, rmarsh.DalliFlagSerialized},
+		{false, 1024, rmarsh.DalliFlagSerialized},
+		{false, 16, rmarsh.DalliFlagSerialized | rmarsh.DalliFlagCompressed},
+		{true, 0, 0},
+		{true, 16, rmarsh.DalliFlagCompressed},
+		// Like Dalli, payloads exactly the minimum size are compressed.
+		{false, b.Len(), rmarsh.DalliFlagSerialized | rmarsh.DalliFlagCompressed},
+		{false, b.Len() + 1, rmarsh.DalliFlagSerialized},
+	}
+
+	for _, test := range tests {
+		val, flags, err := rmarsh.DalliEncode(b.Bytes(), test.raw, test.compressMin)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if flags != test.expFlags {
+			t.Fatalf("Flags %#x != %#x", flags, test.expFlags)
+		}
+
+		payload, serialized, err := rmarsh.DalliDecode(val, flags)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if serialized == test.raw {
+			t.Fatalf("serialized = %v for raw = %v", serialized, test.raw)
+		}
+		if !bytes.Equal(payload, b.Bytes()) {
+			t.Fatalf("Decoded payload %x != %x", payload, b.Bytes())
+		}
+	}
+}
+
+func TestDalliDecodeCorrupt(t *testing.T) {
+	if _, _, err := rmarsh.DalliDecode([]byte("nope"), rmarsh.DalliFlagCompressed); err == nil {
+		t.Fatalf("Expected error")
+	}
+}
+
+func TestIsRedisStoreMarshal(t *testing.T) {
+	if !rmarsh.IsRedisStoreMarshal([]byte{0x04, 0x08, '0'}) {
+		t.Fatalf("Marshal stream not detected")
+	}
+	if rmarsh.IsRedisStoreMarshal([]byte("raw value")) {
+		t.Fatalf("Raw value detected as Marshal stream")
+	}
+}
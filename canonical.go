@@ -0,0 +1,210 @@
+package rmarsh
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"hash"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+type digest [sha256.Size]byte
+
+// Hash reads a complete Marshal stream from r and writes a digest of the logical value it contains to h. Two streams
+// that describe the same value produce the same digest, even if they were written differently: symbols and objects
+// may be linked rather than repeated, hash entries and instance variables may be in any order, and Integers may be
+// Fixnums or Bignums. This makes Hash suitable for deduplicating payloads produced by different writers.
+// The value is reduced to a SHA-256 digest of its canonical form, built up from the digests of its parts, and that
+// digest is what's written to h. String encodings, class names and extended modules are all part of the value. A
+// reference back to an enclosing object is digested by how far up it points.
+// Reads from r are buffered, so bytes past the end of the Marshal stream may be consumed.
+func Hash(r io.Reader, h hash.Hash) error {
+	root, err := readTree(r)
+	if err != nil {
+		return err
+	}
+
+	c := canonicalizer{done: make(map[*node]digest)}
+	d := c.digest(root)
+	_, err = h.Write(d[:])
+	return errors.Wrap(err, "hash")
+}
+
+type canonicalizer struct {
+	done  map[*node]digest // Digests of values that have been completed.
+	stack []*node          // Objects currently being digested.
+}
+
+// A canonicalWriter accumulates the canonical form of a single value.
+type canonicalWriter struct {
+	h hash.Hash
+	b [binary.MaxVarintLen64]byte
+}
+
+func (w *canonicalWriter) num(n int) {
+	w.h.Write(w.b[:binary.PutVarint(w.b[:], int64(n))])
+}
+
+func (w *canonicalWriter) bits(n uint64) {
+	w.h.Write(w.b[:binary.PutUvarint(w.b[:], n)])
+}
+
+func (w *canonicalWriter) str(s []byte) {
+	w.num(len(s))
+	w.h.Write(s)
+}
+
+func (w *canonicalWriter) digest(d digest) {
+	w.h.Write(d[:])
+}
+
+func (c *canonicalizer) digest(n *node) (d digest) {
+	if n.typ == typeLink {
+		if d, ok := c.done[n.ref]; ok {
+			return d
+		}
+		for i := len(c.stack) - 1; i >= 0; i-- {
+			if c.stack[i] == n.ref {
+				w := canonicalWriter{h: sha256.New()}
+				w.h.Write([]byte{typeLink})
+				w.num(len(c.stack) - i)
+				copy(d[:], w.h.Sum(nil))
+				return
+			}
+		}
+		// Links point at an object that is either complete or enclosing this one, so this shouldn't happen.
+		return c.digest(n.ref)
+	}
+
+	c.stack = append(c.stack, n)
+	w := canonicalWriter{h: sha256.New()}
+
+	typ := n.typ
+	switch typ {
+	case typeFixnum, typeBignum:
+		typ = typeFixnum
+	case typeHashDef:
+		typ = typeHash
+	case typeModuleOld:
+		typ = typeModule
+	}
+	w.h.Write([]byte{typ})
+	w.str([]byte(n.class))
+	w.num(len(n.exts))
+	for _, ext := range n.exts {
+		w.str([]byte(ext))
+	}
+
+	vars := n.vars
+	switch n.typ {
+	case typeFixnum:
+		w.str(strconv.AppendInt(nil, int64(n.num), 10))
+
+	case typeBignum:
+		w.str([]byte(bignumString(n.num < 0, n.data)))
+
+	case typeFloat:
+		w.bits(canonicalFloatBits(n.data))
+
+	case typeSymbol:
+		w.str(n.data)
+
+	case typeString, typeRegExp, typeUsrDef:
+		var enc []byte
+		enc, vars = canonicalEncoding(n.vars)
+		w.str(enc)
+		w.str(n.data)
+		if n.typ == typeRegExp {
+			w.num(n.num)
+		}
+
+	case typeArray, typeUsrMarshal, typeData:
+		w.num(len(n.elems))
+		for _, e := range n.elems {
+			w.digest(c.digest(e))
+		}
+
+	case typeHash, typeHashDef:
+		entries := make([][]byte, len(n.elems)/2)
+		for i := range entries {
+			k, v := c.digest(n.elems[i*2]), c.digest(n.elems[i*2+1])
+			entries[i] = append(k[:], v[:]...)
+		}
+		sort.Slice(entries, func(i, j int) bool { return bytes.Compare(entries[i], entries[j]) < 0 })
+		w.num(len(entries))
+		for _, e := range entries {
+			w.h.Write(e)
+		}
+		if n.def != nil {
+			w.digest(c.digest(n.def))
+		}
+
+	case typeStruct:
+		// Struct members are in the order they were declared, which is significant.
+		w.num(len(n.vars))
+		for _, v := range n.vars {
+			w.str([]byte(v.name))
+			w.digest(c.digest(v.val))
+		}
+		vars = nil
+	}
+
+	// Instance variables are unordered.
+	entries := make([][]byte, len(vars))
+	for i, v := range vars {
+		d := c.digest(v.val)
+		entries[i] = append([]byte(v.name+"\x00"), d[:]...)
+	}
+	sort.Slice(entries, func(i, j int) bool { return bytes.Compare(entries[i], entries[j]) < 0 })
+	w.num(len(entries))
+	for _, e := range entries {
+		w.h.Write(e)
+	}
+
+	copy(d[:], w.h.Sum(nil))
+	c.stack = c.stack[:len(c.stack)-1]
+	c.done[n] = d
+	return
+}
+
+// canonicalEncoding returns the name of the encoding described by an ivar list, and the other ivars in the list.
+func canonicalEncoding(vars []nodeVar) (enc []byte, rest []nodeVar) {
+	enc = []byte("ASCII-8BIT")
+	for _, v := range vars {
+		switch {
+		case v.name == "E" && v.val.typ == typeTrue:
+			enc = []byte("UTF-8")
+		case v.name == "E" && v.val.typ == typeFalse:
+			enc = []byte("US-ASCII")
+		case v.name == "encoding" && v.val.typ == typeString:
+			enc = v.val.data
+		default:
+			rest = append(rest, v)
+		}
+	}
+	return
+}
+
+// canonicalFloatBits parses the textual form of a Float in a Marshal stream.
+func canonicalFloatBits(b []byte) uint64 {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	var f float64
+	switch s := string(b); s {
+	case "inf":
+		f = math.Inf(1)
+	case "-inf":
+		f = math.Inf(-1)
+	case "nan":
+		f = math.NaN()
+	default:
+		f, _ = strconv.ParseFloat(s, 64)
+	}
+	return math.Float64bits(f)
+}
@@ -0,0 +1,61 @@
+package rmarsh_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"testing"
+
+	"github.com/samcday/rmarsh"
+)
+
+func canonicalHash(t *testing.T, raw []byte) string {
+	h := sha256.New()
+	if err := rmarsh.Hash(bytes.NewReader(raw), h); err != nil {
+		t.Fatal(err)
+	}
+	return string(h.Sum(nil))
+}
+
+func TestCanonicalHash(t *testing.T) {
+	same := [][2][]byte{
+		{
+			// [{:a => "x", :b => "x"}, :a]
+			{0x04, 0x08, '[', 0x07, '{', 0x07, ':', 0x06, 'a', '"', 0x06, 'x', ':', 0x06, 'b', '"', 0x06, 'x', ';', 0x00},
+			// Same, but the hash is in a different order, and the second "x" is a link.
+			{0x04, 0x08, '[', 0x07, '{', 0x07, ':', 0x06, 'b', '"', 0x06, 'x', ':', 0x06, 'a', '@', 0x07, ';', 0x06},
+		},
+		{
+			// 1 as a Fixnum and as a Bignum.
+			{0x04, 0x08, 'i', 0x06},
+			{0x04, 0x08, 'l', '+', 0x06, 0x01, 0x00},
+		},
+	}
+	for i, pair := range same {
+		if canonicalHash(t, pair[0]) != canonicalHash(t, pair[1]) {
+			t.Errorf("Equivalent values %d have different digests", i)
+		}
+	}
+
+	different := [][]byte{
+		{0x04, 0x08, '"', 0x06, 'x'},
+		{0x04, 0x08, 'I', '"', 0x06, 'x', 0x06, ':', 0x06, 'E', 'T'},
+		{0x04, 0x08, ':', 0x06, 'x'},
+		{0x04, 0x08, 'i', 0x07},
+	}
+	seen := make(map[string]int)
+	for i, raw := range different {
+		d := canonicalHash(t, raw)
+		if j, ok := seen[d]; ok {
+			t.Errorf("Values %d and %d have the same digest", j, i)
+		}
+		seen[d] = i
+	}
+}
+
+func TestCanonicalHashCycle(t *testing.T) {
+	// An array that contains itself.
+	raw := []byte{0x04, 0x08, '[', 0x06, '@', 0x00}
+	if canonicalHash(t, raw) == "" {
+		t.Errorf("Empty digest")
+	}
+}
@@ -0,0 +1,73 @@
+package rmarsh
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// Compression selects an envelope format that wraps a Marshal stream. Ruby code commonly stores
+// Zlib::Deflate.deflate(Marshal.dump(x)) or a gzipped dump rather than the raw Marshal bytes.
+type Compression uint8
+
+// The supported compression formats.
+const (
+	CompressionNone Compression = iota
+	CompressionZlib
+	CompressionGzip
+)
+
+// A compressor is satisfied by both zlib.Writer and gzip.Writer, allowing us to recycle them across streams.
+type compressor interface {
+	io.WriteCloser
+	Reset(w io.Writer)
+}
+
+// NewDecompressor sniffs the first couple of bytes of the provided io.Reader to determine if it contains a zlib or gzip
+// compressed Marshal stream. If so, the returned io.Reader transparently inflates the data. Otherwise, the bytes are
+// passed through untouched. The result is suitable for handing straight to NewParser or Parser.Reset.
+// Exactly two bytes are read from r before returning, nothing is buffered past that.
+func NewDecompressor(r io.Reader) (io.Reader, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, errors.Wrap(err, "sniff")
+	}
+
+	r = io.MultiReader(bytes.NewReader(hdr[:]), r)
+
+	switch sniffCompression(hdr[0], hdr[1]) {
+	case CompressionZlib:
+		zr, err := zlib.NewReader(r)
+		if err != nil {
+			return nil, errors.Wrap(err, "zlib")
+		}
+		return zr, nil
+	case CompressionGzip:
+		gr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, errors.Wrap(err, "gzip")
+		}
+		return gr, nil
+	}
+
+	return r, nil
+}
+
+// sniffCompression examines the first two bytes of a payload and returns the compression format they indicate.
+// A Marshal 4.8 header never collides with either magic: 0x04 is not a valid zlib CMF byte.
+func sniffCompression(b0, b1 byte) Compression {
+	if b0 == 0x1F && b1 == 0x8B {
+		return CompressionGzip
+	}
+	// RFC 1950: CM must be 8 (deflate), CINFO no larger than 7, and CMF*256+FLG must be a multiple of 31.
+	if b0&0x0F == 8 && b0>>4 <= 7 && (uint16(b0)<<8|uint16(b1))%31 == 0 {
+		return CompressionZlib
+	}
+	return CompressionNone
+}
@@ -0,0 +1,56 @@
+package rmarsh_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/samcday/rmarsh"
+)
+
+func TestCompressionRoundTrip(t *testing.T) {
+	for _, c := range []rmarsh.Compression{rmarsh.CompressionNone, rmarsh.CompressionZlib, rmarsh.CompressionGzip} {
+		b := new(bytes.Buffer)
+		gen := rmarsh.NewGenerator(b)
+		gen.SetCompression(c)
+
+		// Write two streams to make sure the compressor is recycled correctly.
+		for i := 0; i < 2; i++ {
+			b.Reset()
+			gen.Reset(nil)
+			if err := gen.Symbol("test"); err != nil {
+				t.Fatal(err)
+			}
+
+			r, err := rmarsh.NewDecompressor(bytes.NewReader(b.Bytes()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			p := rmarsh.NewParser(r)
+			sym, _ := expectToken(t, p, rmarsh.TokenSymbol)
+			if string(sym) != "test" {
+				t.Fatalf("Compression %d: read symbol %q, expected test", c, sym)
+			}
+			expectToken(t, p, rmarsh.TokenEOF)
+		}
+	}
+}
+
+func TestDecompressorShortRead(t *testing.T) {
+	if _, err := rmarsh.NewDecompressor(bytes.NewReader([]byte{0x04})); err == nil {
+		t.Fatalf("Expected error")
+	}
+}
+
+func BenchmarkGenZlib(b *testing.B) {
+	gen := rmarsh.NewGenerator(ioutil.Discard)
+	gen.SetCompression(rmarsh.CompressionZlib)
+
+	for i := 0; i < b.N; i++ {
+		gen.Reset(nil)
+
+		if err := gen.String("test"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -4,8 +4,14 @@ import (
 	"math/big"
 )
 
+// The version of the Marshal format this package reads and writes, which is found in the first two bytes of a stream.
+const (
+	MarshalMajor = 4
+	MarshalMinor = 8
+)
+
 var (
-	magic = []byte{4, 8}
+	magic = []byte{MarshalMajor, MarshalMinor}
 )
 
 const (
@@ -29,8 +35,99 @@ const (
 	typeUsrMarshal = 'U'
 	typeUsrDef     = 'u'
 	typeStruct     = 'S'
+	typeHashDef    = '}'
+	typeModuleOld  = 'M'
+	typeExtended   = 'e'
+	typeUClass     = 'C'
+	typeData       = 'd'
 )
 
+// A TypeTag is the byte that introduces a value in a Marshal stream, and determines how the rest of it is laid out.
+type TypeTag byte
+
+// The type tags of the Marshal 4.8 format.
+const (
+	TypeNil         TypeTag = typeNil
+	TypeTrue        TypeTag = typeTrue
+	TypeFalse       TypeTag = typeFalse
+	TypeFixnum      TypeTag = typeFixnum
+	TypeBignum      TypeTag = typeBignum
+	TypeFloat       TypeTag = typeFloat
+	TypeArray       TypeTag = typeArray
+	TypeHash        TypeTag = typeHash
+	TypeSymbol      TypeTag = typeSymbol
+	TypeSymlink     TypeTag = typeSymlink
+	TypeString      TypeTag = typeString
+	TypeRegexp      TypeTag = typeRegExp
+	TypeIVar        TypeTag = typeIvar
+	TypeClass       TypeTag = typeClass
+	TypeModule      TypeTag = typeModule
+	TypeObject      TypeTag = typeObject
+	TypeLink        TypeTag = typeLink
+	TypeUserMarshal TypeTag = typeUsrMarshal
+	TypeUserDefined TypeTag = typeUsrDef
+	TypeStruct      TypeTag = typeStruct
+	TypeHashDefault TypeTag = typeHashDef
+	TypeModuleOld   TypeTag = typeModuleOld
+	TypeExtended    TypeTag = typeExtended
+	TypeUserClass   TypeTag = typeUClass
+	TypeData        TypeTag = typeData
+)
+
+var typeTagNames = map[TypeTag]string{
+	TypeNil:         "Nil",
+	TypeTrue:        "True",
+	TypeFalse:       "False",
+	TypeFixnum:      "Fixnum",
+	TypeBignum:      "Bignum",
+	TypeFloat:       "Float",
+	TypeArray:       "Array",
+	TypeHash:        "Hash",
+	TypeSymbol:      "Symbol",
+	TypeSymlink:     "Symlink",
+	TypeString:      "String",
+	TypeRegexp:      "Regexp",
+	TypeIVar:        "IVar",
+	TypeClass:       "Class",
+	TypeModule:      "Module",
+	TypeObject:      "Object",
+	TypeLink:        "Link",
+	TypeUserMarshal: "UserMarshal",
+	TypeUserDefined: "UserDefined",
+	TypeStruct:      "Struct",
+	TypeHashDefault: "HashDefault",
+	TypeModuleOld:   "ModuleOld",
+	TypeExtended:    "Extended",
+	TypeUserClass:   "UserClass",
+	TypeData:        "Data",
+}
+
+func (t TypeTag) String() string {
+	if n, ok := typeTagNames[t]; ok {
+		return n
+	}
+	return "Unknown"
+}
+
+// TypeOf returns the TypeTag represented by b, and whether b is a valid type tag at all.
+func TypeOf(b byte) (TypeTag, bool) {
+	_, ok := typeTagNames[TypeTag(b)]
+	return TypeTag(b), ok
+}
+
+// typeName returns the name of the type of value introduced by typ, as reported by the likes of NewGraph and Probe.
+// Hashes with a default value and old style modules are named after the type of value they produce.
+func typeName(typ byte) string {
+	switch t := TypeTag(typ); t {
+	case TypeHashDefault:
+		return TypeHash.String()
+	case TypeModuleOld:
+		return TypeModule.String()
+	default:
+		return t.String()
+	}
+}
+
 // Modifier flags for Ruby regular expressions
 const (
 	RegexpIgnoreCase    = 1
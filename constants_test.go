@@ -0,0 +1,30 @@
+package rmarsh_test
+
+import (
+	"testing"
+
+	"github.com/samcday/rmarsh"
+)
+
+func TestTypeOf(t *testing.T) {
+	for _, tc := range []struct {
+		b    byte
+		name string
+		ok   bool
+	}{
+		{'0', "Nil", true},
+		{'[', "Array", true},
+		{';', "Symlink", true},
+		{'}', "HashDefault", true},
+		{'C', "UserClass", true},
+		{'x', "Unknown", false},
+	} {
+		typ, ok := rmarsh.TypeOf(tc.b)
+		if ok != tc.ok || typ.String() != tc.name {
+			t.Errorf("TypeOf(%q) = %s, %v, expected %s, %v", tc.b, typ, ok, tc.name, tc.ok)
+		}
+	}
+	if rmarsh.TypeIVar != 'I' {
+		t.Errorf("TypeIVar = %q", rmarsh.TypeIVar)
+	}
+}
@@ -0,0 +1,181 @@
+package rmarsh
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// Defaults of DRb's load_limit and argc_limit, which bound the size of a message part and the number of arguments.
+const (
+	DRbLoadLimit = 25 * 1024 * 1024
+	DRbArgcLimit = 256
+)
+
+var drbNil = []byte{magic[0], magic[1], typeNil}
+
+// A DRbRequest is a method call sent from a DRb client to a server. Ref, each of Args, and Block hold complete Marshal
+// streams. A nil Ref or Block is sent as a Marshal nil.
+type DRbRequest struct {
+	Ref   []byte   // Reference to the receiving object. nil refers to the server's front object.
+	Msg   string   // Name of the method to call.
+	Args  [][]byte // Arguments of the method call.
+	Block []byte   // Block passed to the method call, usually nil.
+}
+
+// A DRbReply is the response to a DRbRequest. If OK is set, Result holds the Marshal stream of the return value of the
+// method call, otherwise it holds the exception that was raised.
+type DRbReply struct {
+	OK     bool
+	Result []byte
+}
+
+// WriteDRbRequest writes a request in the DRb wire protocol to w. Each part of the request is written as a 4 byte
+// big endian length followed by the Marshal stream, as DRb expects.
+func WriteDRbRequest(w io.Writer, req *DRbRequest) error {
+	var msg bytes.Buffer
+	gen := NewGenerator(&msg)
+	if err := gen.utf8String(req.Msg); err != nil {
+		return err
+	}
+	var argc bytes.Buffer
+	gen.Reset(&argc)
+	if err := gen.Fixnum(int64(len(req.Args))); err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(w)
+	drbWritePart(bw, req.Ref)
+	drbWritePart(bw, msg.Bytes())
+	drbWritePart(bw, argc.Bytes())
+	for _, arg := range req.Args {
+		drbWritePart(bw, arg)
+	}
+	drbWritePart(bw, req.Block)
+	return errors.Wrap(bw.Flush(), "write DRb request")
+}
+
+// ReadDRbRequest reads a request in the DRb wire protocol from r. Like DRb, it refuses message parts larger than
+// DRbLoadLimit and calls with more than DRbArgcLimit arguments.
+func ReadDRbRequest(r io.Reader) (*DRbRequest, error) {
+	req := new(DRbRequest)
+	var err error
+	if req.Ref, err = drbReadPart(r); err != nil {
+		return nil, err
+	}
+
+	part, err := drbReadPart(r)
+	if err != nil {
+		return nil, err
+	}
+	sc, err := drbScalar(part)
+	if err != nil {
+		return nil, err
+	}
+	if sc.typ != typeString {
+		return nil, errors.Errorf("DRb message name is a %s, not a String", typeName(sc.typ))
+	}
+	req.Msg = string(sc.str)
+
+	if part, err = drbReadPart(r); err != nil {
+		return nil, err
+	}
+	if sc, err = drbScalar(part); err != nil {
+		return nil, err
+	}
+	if sc.typ != typeFixnum || sc.num < 0 || sc.num > DRbArgcLimit {
+		return nil, errors.Errorf("invalid DRb argument count")
+	}
+
+	req.Args = make([][]byte, sc.num)
+	for i := range req.Args {
+		if req.Args[i], err = drbReadPart(r); err != nil {
+			return nil, err
+		}
+	}
+	if req.Block, err = drbReadPart(r); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// WriteDRbReply writes a reply in the DRb wire protocol to w.
+func WriteDRbReply(w io.Writer, rep *DRbReply) error {
+	succ := []byte{magic[0], magic[1], typeFalse}
+	if rep.OK {
+		succ[2] = typeTrue
+	}
+
+	bw := bufio.NewWriter(w)
+	drbWritePart(bw, succ)
+	drbWritePart(bw, rep.Result)
+	return errors.Wrap(bw.Flush(), "write DRb reply")
+}
+
+// ReadDRbReply reads a reply in the DRb wire protocol from r.
+func ReadDRbReply(r io.Reader) (*DRbReply, error) {
+	part, err := drbReadPart(r)
+	if err != nil {
+		return nil, err
+	}
+	sc, err := drbScalar(part)
+	if err != nil {
+		return nil, err
+	}
+	if sc.typ != typeTrue && sc.typ != typeFalse {
+		return nil, errors.Errorf("DRb reply status is a %s, not a boolean", typeName(sc.typ))
+	}
+
+	rep := &DRbReply{OK: sc.typ == typeTrue}
+	if rep.Result, err = drbReadPart(r); err != nil {
+		return nil, err
+	}
+	return rep, nil
+}
+
+func drbWritePart(w *bufio.Writer, part []byte) {
+	if part == nil {
+		part = drbNil
+	}
+	var hdr [4]byte
+	binary.BigEndian.PutUint32(hdr[:], uint32(len(part)))
+	w.Write(hdr[:])
+	w.Write(part)
+}
+
+func drbReadPart(r io.Reader) ([]byte, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, errors.Wrap(err, "read DRb message length")
+	}
+	n := binary.BigEndian.Uint32(hdr[:])
+	if n > DRbLoadLimit {
+		return nil, LimitError{"DRb load", DRbLoadLimit, 0}
+	}
+	part := make([]byte, n)
+	if _, err := io.ReadFull(r, part); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, errors.Wrap(err, "read DRb message")
+	}
+	return part, nil
+}
+
+// drbScalar reads the simple value held in a message part.
+func drbScalar(part []byte) (sc scalar, err error) {
+	s := scanner{r: bufio.NewReader(bytes.NewReader(part))}
+	if err = s.header(); err == nil {
+		err = s.valueOf(&sc, -1, false)
+	}
+	if err != nil && err != errScanStop {
+		return
+	}
+	if !s.report.Valid() {
+		err = errors.Errorf("invalid Marshal stream: %s", s.report.Findings[0])
+	}
+	return
+}
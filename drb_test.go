@@ -0,0 +1,57 @@
+package rmarsh_test
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/samcday/rmarsh"
+)
+
+func TestDRbRequest(t *testing.T) {
+	one := []byte{0x04, 0x08, 'i', 0x06}
+	req := &rmarsh.DRbRequest{Msg: "hello", Args: [][]byte{one}}
+
+	var buf bytes.Buffer
+	if err := rmarsh.WriteDRbRequest(&buf, req); err != nil {
+		t.Fatal(err)
+	}
+	exp := []byte{
+		0, 0, 0, 3, 0x04, 0x08, '0',
+		0, 0, 0, 15, 0x04, 0x08, 'I', '"', 0x0A, 'h', 'e', 'l', 'l', 'o', 0x06, ':', 0x06, 'E', 'T',
+		0, 0, 0, 4, 0x04, 0x08, 'i', 0x06,
+		0, 0, 0, 4, 0x04, 0x08, 'i', 0x06,
+		0, 0, 0, 3, 0x04, 0x08, '0',
+	}
+	if !bytes.Equal(buf.Bytes(), exp) {
+		t.Fatalf("Wrote %X, expected %X", buf.Bytes(), exp)
+	}
+
+	got, err := rmarsh.ReadDRbRequest(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nilStream := []byte{0x04, 0x08, '0'}
+	if exp := (&rmarsh.DRbRequest{Ref: nilStream, Msg: "hello", Args: [][]byte{one}, Block: nilStream}); !reflect.DeepEqual(got, exp) {
+		t.Errorf("Read %+v, expected %+v", got, exp)
+	}
+}
+
+func TestDRbReply(t *testing.T) {
+	var buf bytes.Buffer
+	rep := &rmarsh.DRbReply{OK: true, Result: []byte{0x04, 0x08, 'T'}}
+	if err := rmarsh.WriteDRbReply(&buf, rep); err != nil {
+		t.Fatal(err)
+	}
+	got, err := rmarsh.ReadDRbReply(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, rep) {
+		t.Errorf("Read %+v, expected %+v", got, rep)
+	}
+
+	if _, err := rmarsh.ReadDRbReply(bytes.NewReader([]byte{0xFF, 0, 0, 0})); err == nil {
+		t.Errorf("Expected error for oversized part")
+	}
+}
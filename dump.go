@@ -0,0 +1,151 @@
+package rmarsh
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"strconv"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+// The number of bytes of a value DumpTokens will include in a TokenRecord.
+const tokenPreviewLen = 64
+
+// A TokenRecord describes a single element of a Marshal stream, as written by DumpTokens.
+type TokenRecord struct {
+	Token  TypeTag `json:"token"`            // Type tag of the element.
+	Offset int     `json:"offset"`           // Offset of the element in the stream.
+	Length int     `json:"length,omitempty"` // Number of bytes the element occupies, including any values nested in it.
+	Depth  int     `json:"depth"`            // Nesting depth of the element, 0 for the top level value.
+	Start  bool    `json:"start,omitempty"`  // Set if this record only marks the beginning of the element.
+	End    bool    `json:"end,omitempty"`    // Set if this record completes an element that has a Start record.
+	ID     *int    `json:"id,omitempty"`     // Link id of a linkable object or link, or symbol id of a symbol or symlink.
+	Len    int     `json:"len,omitempty"`    // Declared length of an Array, Hash, object, Struct or ivar list.
+	Value  string  `json:"value,omitempty"`  // Preview of the value, or the name of the class or module it involves.
+}
+
+// MarshalText renders the tag by name, so TokenRecords serialize to readable JSON.
+func (t TypeTag) MarshalText() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+
+// DumpTokens reads a complete Marshal stream from r, and writes TokenRecords describing each element in it to w as
+// newline delimited JSON, as it goes. Unlike WriteRuby, this preserves the structure of the stream on the wire: ivar
+// wrappers, links, symlinks and the symbols naming classes and instance variables all get records of their own. The
+// output is intended for piping into tools like jq.
+// Records are written in stream order. Elements that other elements are nested in, like Arrays, Hashes, objects and
+// wrappers, get a Start record when they begin and an End record with the rest of their details once everything in
+// them has been read. Every other element gets a single record.
+// If the stream is invalid, the records for the elements read before the problem are written, and an error describing
+// it is returned. Reads from r and writes to w are buffered, so bytes past the end of the Marshal stream may be
+// consumed.
+func DumpTokens(w io.Writer, r io.Reader) error {
+	bw := bufio.NewWriter(w)
+	d := tokenDumper{enc: json.NewEncoder(bw)}
+	s := scanner{r: bufio.NewReader(r), visit: &d, keep: true}
+	err := s.stream()
+	if ferr := bw.Flush(); ferr != nil {
+		return errors.Wrap(ferr, "write tokens")
+	}
+	if err != nil && err != errScanStop {
+		return err
+	}
+	if !s.report.Valid() {
+		return errors.Errorf("invalid Marshal stream: %s", s.report.Findings[0])
+	}
+	return nil
+}
+
+// A tokenDumper writes TokenRecords for the elements read by a scanner, so problems with the stream are reported as
+// findings.
+type tokenDumper struct {
+	enc  *json.Encoder
+	nest int
+}
+
+func (d *tokenDumper) begin(e *scanElem) error {
+	d.nest++
+	if !tokenNests(e.typ) {
+		return nil
+	}
+	return d.write(&TokenRecord{Token: TypeTag(e.typ), Offset: e.off, Depth: d.nest - 1, Start: true})
+}
+
+// linked has nothing to do, the link id is written along with the rest of the element.
+func (d *tokenDumper) linked(e *scanElem) {}
+
+func (d *tokenDumper) end(e *scanElem) error {
+	d.nest--
+	rec := TokenRecord{
+		Token:  TypeTag(e.typ),
+		Offset: e.off,
+		Length: e.size,
+		Depth:  d.nest,
+		End:    tokenNests(e.typ),
+	}
+	if e.id >= 0 {
+		id := e.id
+		rec.ID = &id
+	}
+
+	// Strings and the like declare a length too, but it's implied by Length.
+	switch e.typ {
+	case typeArray, typeHash, typeHashDef, typeObject, typeStruct, typeIvar:
+		rec.Len = e.len
+	}
+
+	switch e.typ {
+	case typeFixnum:
+		rec.Value = strconv.Itoa(e.num)
+	case typeBignum:
+		rec.Value = tokenPreview([]byte(bignumString(e.num < 0, e.data)))
+	case typeFloat:
+		b := e.data
+		// Ancient versions of Ruby appended mantissa bits after a NUL byte.
+		if n := bytes.IndexByte(b, 0); n >= 0 {
+			b = b[:n]
+		}
+		rec.Value = tokenPreview(b)
+	case typeString, typeRegExp, typeClass, typeModule, typeModuleOld:
+		rec.Value = tokenPreview(e.data)
+	default:
+		rec.Value = tokenPreview([]byte(e.sym))
+	}
+	return d.write(&rec)
+}
+
+func (d *tokenDumper) write(rec *TokenRecord) error {
+	if err := d.enc.Encode(rec); err != nil {
+		return errors.Wrap(err, "write tokens")
+	}
+	return nil
+}
+
+// tokenNests reports whether other elements may be nested in an element of the given type.
+func tokenNests(typ byte) bool {
+	switch typ {
+	case typeArray, typeHash, typeHashDef, typeIvar, typeObject, typeStruct, typeUsrMarshal, typeData, typeUsrDef,
+		typeExtended, typeUClass:
+		return true
+	}
+	return false
+}
+
+// tokenPreview renders the first tokenPreviewLen bytes of a value, quoting it if it isn't valid UTF-8.
+func tokenPreview(b []byte) string {
+	s := string(b)
+	if !utf8.Valid(b) {
+		s = strconv.QuoteToASCII(s)
+	}
+	if len(s) > tokenPreviewLen {
+		n := tokenPreviewLen
+		for !utf8.RuneStart(s[n]) {
+			n--
+		}
+		s = s[:n] + "..."
+	}
+	return s
+}
@@ -0,0 +1,86 @@
+package rmarsh_test
+
+import (
+	"bytes"
+	"testing"
+	"testing/iotest"
+
+	"github.com/samcday/rmarsh"
+)
+
+func TestDumpTokens(t *testing.T) {
+	raw := []byte{0x04, 0x08, '[', 0x09, ':', 0x06, 'a', ';', 0x00, 'I', '"', 0x06, 'x', 0x06, ':', 0x06, 'E', 'T', '@', 0x06}
+
+	var buf bytes.Buffer
+	if err := rmarsh.DumpTokens(&buf, bytes.NewReader(raw)); err != nil {
+		t.Fatal(err)
+	}
+
+	exp := `{"token":"Array","offset":2,"depth":0,"start":true}
+{"token":"Symbol","offset":4,"length":3,"depth":1,"id":0,"value":"a"}
+{"token":"Symlink","offset":7,"length":2,"depth":1,"id":0,"value":"a"}
+{"token":"IVar","offset":9,"depth":1,"start":true}
+{"token":"String","offset":10,"length":3,"depth":2,"id":1,"value":"x"}
+{"token":"Symbol","offset":14,"length":3,"depth":2,"id":1,"value":"E"}
+{"token":"True","offset":17,"length":1,"depth":2}
+{"token":"IVar","offset":9,"length":9,"depth":1,"end":true,"len":1}
+{"token":"Link","offset":18,"length":2,"depth":1,"id":1}
+{"token":"Array","offset":2,"length":18,"depth":0,"end":true,"id":0,"len":4}
+`
+	if buf.String() != exp {
+		t.Errorf("Unexpected dump:\n%s", buf.String())
+	}
+}
+
+func TestDumpTokensInvalid(t *testing.T) {
+	var buf bytes.Buffer
+	err := rmarsh.DumpTokens(&buf, bytes.NewReader([]byte{0x04, 0x08, '[', 0x07, 'T', 'x'}))
+	if err == nil {
+		t.Fatal("Expected error")
+	}
+
+	exp := `{"token":"Array","offset":2,"depth":0,"start":true}
+{"token":"True","offset":4,"length":1,"depth":1}
+`
+	if buf.String() != exp {
+		t.Errorf("Unexpected dump:\n%s", buf.String())
+	}
+}
+
+// Ruby links a user defined object wrapped in an ivar after the ivars of its data, so the link id is on the ivar record.
+func TestDumpTokensUserDefined(t *testing.T) {
+	raw := []byte{0x04, 0x08, 'I', 'u', ':', 0x08, 'F', 'o', 'o', 0x07, 'a', 'b', 0x06, ':', 0x07, '@', 'x', '"', 0x06, 'y'}
+
+	var buf bytes.Buffer
+	if err := rmarsh.DumpTokens(&buf, bytes.NewReader(raw)); err != nil {
+		t.Fatal(err)
+	}
+	exp := `{"token":"IVar","offset":2,"depth":0,"start":true}
+{"token":"UserDefined","offset":3,"depth":1,"start":true}
+{"token":"Symbol","offset":4,"length":5,"depth":2,"id":0,"value":"Foo"}
+{"token":"UserDefined","offset":3,"length":9,"depth":1,"end":true,"value":"Foo"}
+{"token":"Symbol","offset":13,"length":4,"depth":1,"id":1,"value":"@x"}
+{"token":"String","offset":17,"length":3,"depth":1,"id":0,"value":"y"}
+{"token":"IVar","offset":2,"length":18,"depth":0,"end":true,"id":1,"len":1}
+`
+	if buf.String() != exp {
+		t.Errorf("Unexpected dump:\n%s", buf.String())
+	}
+}
+
+// Records are written as the stream is read, so the ones read before a failing read aren't lost.
+func TestDumpTokensReadError(t *testing.T) {
+	raw := []byte{0x04, 0x08, '[', 0x07, 'T'}
+
+	var buf bytes.Buffer
+	if err := rmarsh.DumpTokens(&buf, iotest.TimeoutReader(bytes.NewReader(raw))); err != iotest.ErrTimeout {
+		t.Fatalf("DumpTokens() = %v, expected %v", err, iotest.ErrTimeout)
+	}
+
+	exp := `{"token":"Array","offset":2,"depth":0,"start":true}
+{"token":"True","offset":4,"length":1,"depth":1}
+`
+	if buf.String() != exp {
+		t.Errorf("Unexpected dump:\n%s", buf.String())
+	}
+}
@@ -0,0 +1,75 @@
+package rmarsh
+
+import (
+	"bufio"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// Rough per-item memory costs used by SizeEstimate.Bytes, based on what a typical Go representation needs: an interface
+// value for every value, plus a string header for strings and symbols, and bucket overhead for hash entries.
+const (
+	estValueCost     = 16
+	estStringCost    = 16
+	estHashEntryCost = 32
+)
+
+// A SizeEstimate summarises the contents of a Marshal stream, as counted by EstimateSize.
+type SizeEstimate struct {
+	Values      int `json:"values"`       // Total number of values, including nested ones, links and symlinks.
+	Strings     int `json:"strings"`      // Number of Strings and Regexps.
+	StringBytes int `json:"string_bytes"` // Combined length of all Strings and Regexps.
+	Symbols     int `json:"symbols"`      // Number of distinct Symbols defined.
+	SymbolBytes int `json:"symbol_bytes"` // Combined length of all distinct Symbols.
+	Arrays      int `json:"arrays"`
+	ArrayElems  int `json:"array_elems"` // Combined length of all Arrays.
+	Hashes      int `json:"hashes"`
+	HashEntries int `json:"hash_entries"` // Combined length of all Hashes.
+	Objects     int `json:"objects"`      // Number of objects and structs.
+	ObjectVars  int `json:"object_vars"`  // Combined number of instance variables and members of objects and structs.
+
+	// Bytes is a rough approximation of the memory needed to hold the decoded stream in Go. It's only intended to
+	// compare payloads against a budget, and shouldn't be relied on to be accurate.
+	Bytes int `json:"bytes"`
+}
+
+// add accounts for a length read from the stream, as described by the scanner.
+func (e *SizeEstimate) add(what string, n int) {
+	switch what {
+	case "string", "regexp":
+		e.Strings++
+		e.StringBytes += n
+	case "symbol":
+		e.Symbols++
+		e.SymbolBytes += n
+	case "array":
+		e.Arrays++
+		e.ArrayElems += n
+	case "hash":
+		e.Hashes++
+		e.HashEntries += n
+	case "object":
+		e.Objects++
+		e.ObjectVars += n
+	}
+}
+
+// EstimateSize reads a complete Marshal stream from r and counts the values within it, without decoding any of them.
+// This allows services to reject payloads that would be too expensive to decode before committing to it. Reads from r
+// are buffered, so bytes past the end of the Marshal stream may be consumed.
+// An error is returned if the stream is invalid; use Validate to learn more about why.
+func EstimateSize(r io.Reader) (*SizeEstimate, error) {
+	est := new(SizeEstimate)
+	s := scanner{r: bufio.NewReader(r), est: est}
+	if err := s.stream(); err != nil && err != errScanStop {
+		return nil, err
+	}
+	if !s.report.Valid() {
+		return nil, errors.Errorf("invalid Marshal stream: %s", s.report.Findings[0])
+	}
+
+	est.Bytes = est.Values*estValueCost + (est.Strings+est.Symbols)*estStringCost + est.StringBytes + est.SymbolBytes +
+		est.HashEntries*estHashEntryCost
+	return est, nil
+}
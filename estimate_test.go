@@ -0,0 +1,72 @@
+package rmarsh_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/samcday/rmarsh"
+)
+
+func TestEstimateSize(t *testing.T) {
+	// [{:a => "foo"}, {:a => "quux"}, :bb, 1]
+	raw := genStream(t, func(gen *rmarsh.Generator) error {
+		if err := gen.StartArray(4); err != nil {
+			return err
+		}
+		if err := gen.StartHash(1); err != nil {
+			return err
+		}
+		if err := gen.Symbol("a"); err != nil {
+			return err
+		}
+		if err := gen.String("foo"); err != nil {
+			return err
+		}
+		if err := gen.EndHash(); err != nil {
+			return err
+		}
+		if err := gen.StartHash(1); err != nil {
+			return err
+		}
+		if err := gen.Symbol("a"); err != nil {
+			return err
+		}
+		if err := gen.String("quux"); err != nil {
+			return err
+		}
+		if err := gen.EndHash(); err != nil {
+			return err
+		}
+		if err := gen.Symbol("bb"); err != nil {
+			return err
+		}
+		if err := gen.Fixnum(1); err != nil {
+			return err
+		}
+		return gen.EndArray()
+	})
+
+	est, err := rmarsh.EstimateSize(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := rmarsh.SizeEstimate{
+		Values:      9,
+		Strings:     2,
+		StringBytes: 7,
+		Symbols:     2,
+		SymbolBytes: 3,
+		Arrays:      1,
+		ArrayElems:  4,
+		Hashes:      2,
+		HashEntries: 2,
+		Bytes:       9*16 + 4*16 + 7 + 3 + 2*32,
+	}
+	if *est != exp {
+		t.Errorf("EstimateSize() = %+v, expected %+v", *est, exp)
+	}
+
+	if _, err := rmarsh.EstimateSize(bytes.NewReader([]byte{0x04, 0x08, '['})); err == nil {
+		t.Errorf("Expected error for truncated stream")
+	}
+}
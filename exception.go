@@ -0,0 +1,88 @@
+package rmarsh
+
+import (
+	"runtime"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+type stackTracer interface {
+	StackTrace() errors.StackTrace
+}
+
+// Exception writes e to the Marshal stream as an instance of the named Ruby exception class (e.g "RuntimeError"), so
+// that failures in Go code can be handed to Ruby job queues and error trackers, and rendered there like any other
+// exception. The message of the exception is e.Error(), which includes the messages of any errors e wraps. If e or an
+// error it wraps carries a stack trace from github.com/pkg/errors, the innermost one becomes the backtrace of the
+// exception, in Ruby's "file:line:in `method'" form. Otherwise the backtrace is nil.
+// The message and backtrace are written to the mesg and bt instance variables, which is where Ruby's Exception keeps
+// them. A nil e is an error, and nothing is written for it.
+func (gen *Generator) Exception(class string, e error) error {
+	if e == nil {
+		return errors.Errorf("nil error for %s Exception", class)
+	}
+	bt := exceptionBacktrace(e)
+
+	if err := gen.StartObject(class, 2); err != nil {
+		return err
+	}
+	if err := gen.Symbol("mesg"); err != nil {
+		return err
+	}
+	if err := gen.utf8String(e.Error()); err != nil {
+		return err
+	}
+	if err := gen.Symbol("bt"); err != nil {
+		return err
+	}
+	if bt == nil {
+		if err := gen.Nil(); err != nil {
+			return err
+		}
+	} else {
+		if err := gen.StartArray(len(bt)); err != nil {
+			return err
+		}
+		for _, line := range bt {
+			if err := gen.utf8String(line); err != nil {
+				return err
+			}
+		}
+		if err := gen.EndArray(); err != nil {
+			return err
+		}
+	}
+	return gen.EndObject()
+}
+
+// exceptionBacktrace renders the innermost stack trace in the chain of errors e wraps.
+func exceptionBacktrace(e error) (bt []string) {
+	var st errors.StackTrace
+	for e != nil {
+		if t, ok := e.(stackTracer); ok {
+			st = t.StackTrace()
+		}
+		switch w := e.(type) {
+		case interface{ Unwrap() error }:
+			e = w.Unwrap()
+		case interface{ Cause() error }:
+			e = w.Cause()
+		default:
+			e = nil
+		}
+	}
+
+	for _, f := range st {
+		// A Frame is a program counter, plus one.
+		pc := uintptr(f) - 1
+		fn := runtime.FuncForPC(pc)
+		if fn == nil {
+			bt = append(bt, "unknown")
+			continue
+		}
+		file, line := fn.FileLine(pc)
+		bt = append(bt, file+":"+strconv.Itoa(line)+":in `"+fn.Name()+"'")
+	}
+	return
+}
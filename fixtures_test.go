@@ -0,0 +1,201 @@
+package rmarsh_test
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/samcday/rmarsh"
+)
+
+// The golden fixtures in testdata/ allow the Parser and Generator to be verified without a local Ruby interpreter.
+// Each fixture consists of a .marshal file containing the raw stream Ruby produced for an expression, and a .tokens
+// file describing the tokens the Parser is expected to read from it.
+// After adding a new entry to the fixtures table, regenerate the testdata by running
+// "go test -run TestFixtures -update-fixtures" with Ruby available.
+var updateFixtures = flag.Bool("update-fixtures", false, "Regenerate golden fixtures in testdata/ using Ruby")
+
+var fixtures = []struct {
+	name string
+	expr string
+}{
+	{"nil", "nil"},
+	{"true", "true"},
+	{"false", "false"},
+	{"fixnum_zero", "0"},
+	{"fixnum_one", "1"},
+	{"fixnum_neg_one", "-1"},
+	{"fixnum_122", "122"},
+	{"fixnum_123", "123"},
+	{"fixnum_neg_123", "-123"},
+	{"fixnum_neg_124", "-124"},
+	{"fixnum_0xff", "0xFF"},
+	{"fixnum_0xdead", "0xDEAD"},
+	{"fixnum_max", "0x3FFFFFFF"},
+	{"fixnum_min", "-0x40000000"},
+	{"float", "123.321"},
+	{"float_whole", "1.0"},
+	{"symbol", ":test"},
+	{"array_empty", "[]"},
+	{"array_nested", "[[], [1]]"},
+	{"array_symlink", "[:test, :test]"},
+	{"hash_empty", "{}"},
+	{"hash", "{:a => 1, :b => [{}]}"},
+	{"string", `"test"`},
+	{"string_binary", `"test".b`},
+	// Ruby 2.7+ flags hashes that were passed through a ruby2_keywords method with a K instance variable.
+	{"hash_ruby2_keywords", "Hash.ruby2_keywords_hash({:a => 1})"},
+}
+
+func fixturePath(name, ext string) string {
+	return filepath.Join("testdata", name+ext)
+}
+
+// dumpTokens renders the full token stream read from a Parser in the textual form stored in .tokens files.
+func dumpTokens(p *rmarsh.Parser) (string, error) {
+	var b bytes.Buffer
+	for {
+		tok, data, n, err := p.Read()
+		if err != nil {
+			return "", err
+		}
+
+		switch tok {
+		case rmarsh.TokenFixnum, rmarsh.TokenStartArray, rmarsh.TokenStartHash, rmarsh.TokenIVarProps:
+			fmt.Fprintf(&b, "%s %d\n", tok, n)
+		case rmarsh.TokenFloat, rmarsh.TokenSymbol, rmarsh.TokenString:
+			fmt.Fprintf(&b, "%s %q\n", tok, data)
+		default:
+			fmt.Fprintf(&b, "%s\n", tok)
+		}
+
+		if tok == rmarsh.TokenEOF {
+			return b.String(), nil
+		}
+	}
+}
+
+// regenerate feeds the token stream read from a Parser into a Generator, which should produce a byte-identical stream.
+func regenerate(p *rmarsh.Parser) ([]byte, error) {
+	var b bytes.Buffer
+	gen := rmarsh.NewGenerator(&b)
+	for {
+		tok, data, n, err := p.Read()
+		if err != nil {
+			return nil, err
+		}
+
+		switch tok {
+		case rmarsh.TokenNil:
+			err = gen.Nil()
+		case rmarsh.TokenTrue, rmarsh.TokenFalse:
+			err = gen.Bool(tok == rmarsh.TokenTrue)
+		case rmarsh.TokenFixnum:
+			err = gen.Fixnum(int64(n))
+		case rmarsh.TokenFloat:
+			var f float64
+			if f, err = strconv.ParseFloat(string(data), 64); err == nil {
+				err = gen.Float(f)
+			}
+		case rmarsh.TokenSymbol:
+			err = gen.Symbol(string(data))
+		case rmarsh.TokenString:
+			err = gen.StringBytes(data)
+		case rmarsh.TokenStartArray:
+			err = gen.StartArray(n)
+		case rmarsh.TokenEndArray:
+			err = gen.EndArray()
+		case rmarsh.TokenStartHash:
+			err = gen.StartHash(n)
+		case rmarsh.TokenEndHash:
+			err = gen.EndHash()
+		case rmarsh.TokenStartIVar:
+			var l int
+			if l, err = ivarLen(p); err == nil {
+				err = gen.StartIVar(l)
+			}
+		case rmarsh.TokenIVarProps:
+			// The Generator writes the number of instance variables itself.
+		case rmarsh.TokenEndIVar:
+			err = gen.EndIVar()
+		case rmarsh.TokenEOF:
+			return b.Bytes(), nil
+		default:
+			err = fmt.Errorf("Unsupported token %s", tok)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// ivarLen looks ahead to find the number of instance variables of the ivar the Parser has just started reading, which
+// the Generator needs up front. The Parser is rewound afterwards.
+func ivarLen(p *rmarsh.Parser) (int, error) {
+	m := p.Save()
+	depth := 0
+	for {
+		tok, _, n, err := p.Read()
+		if err != nil {
+			return 0, err
+		}
+		switch tok {
+		case rmarsh.TokenStartArray, rmarsh.TokenStartHash, rmarsh.TokenStartIVar:
+			depth++
+		case rmarsh.TokenEndArray, rmarsh.TokenEndHash, rmarsh.TokenEndIVar:
+			depth--
+		case rmarsh.TokenIVarProps:
+			if depth == 0 {
+				return n, p.Restore(m)
+			}
+		}
+	}
+}
+
+func TestFixtures(t *testing.T) {
+	for _, fixture := range fixtures {
+		if *updateFixtures {
+			raw := rbEncode(t, fixture.expr)
+			toks, err := dumpTokens(rmarsh.NewParser(bytes.NewReader(raw)))
+			if err != nil {
+				t.Fatalf("Fixture %s: %s", fixture.name, err)
+			}
+			if err := ioutil.WriteFile(fixturePath(fixture.name, ".marshal"), raw, 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(fixturePath(fixture.name, ".tokens"), []byte(toks), 0644); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+
+		raw, err := ioutil.ReadFile(fixturePath(fixture.name, ".marshal"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		exp, err := ioutil.ReadFile(fixturePath(fixture.name, ".tokens"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		toks, err := dumpTokens(rmarsh.NewParser(bytes.NewReader(raw)))
+		if err != nil {
+			t.Fatalf("Fixture %s: %s", fixture.name, err)
+		}
+		if toks != string(exp) {
+			t.Errorf("Fixture %s: parsed tokens\n%s\nexpected\n%s", fixture.name, toks, exp)
+		}
+
+		gen, err := regenerate(rmarsh.NewParser(bytes.NewReader(raw)))
+		if err != nil {
+			t.Fatalf("Fixture %s: %s", fixture.name, err)
+		}
+		if !bytes.Equal(gen, raw) {
+			t.Errorf("Fixture %s: generated %x, expected %x", fixture.name, gen, raw)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package rmarsh
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+
+	"github.com/pkg/errors"
+)
+
+// ErrChecksumMismatch is the error returned when the checksum trailing a framed Marshal stream does not match its
+// payload.
+var ErrChecksumMismatch = fmt.Errorf("Frame checksum does not match payload")
+
+// Checksum identifies an integrity check that can be appended to a framed Marshal stream.
+type Checksum uint8
+
+// The supported checksums.
+const (
+	ChecksumNone   Checksum = iota
+	ChecksumCRC32           // 4 byte big endian CRC-32 (IEEE) of the payload.
+	ChecksumSHA256          // 32 byte SHA-256 digest of the payload.
+)
+
+func (c Checksum) size() int {
+	switch c {
+	case ChecksumCRC32:
+		return crc32.Size
+	case ChecksumSHA256:
+		return sha256.Size
+	}
+	return 0
+}
+
+// sum appends the checksum of payload to dst.
+func (c Checksum) sum(dst, payload []byte) []byte {
+	switch c {
+	case ChecksumCRC32:
+		var b [crc32.Size]byte
+		binary.BigEndian.PutUint32(b[:], crc32.ChecksumIEEE(payload))
+		return append(dst, b[:]...)
+	case ChecksumSHA256:
+		b := sha256.Sum256(payload)
+		return append(dst, b[:]...)
+	}
+	return dst
+}
+
+// Framing describes how a Marshal stream is wrapped for transport inside another binary protocol. The zero value
+// performs no framing.
+// A frame consists of an optional length prefix, the payload (a complete Marshal stream, compressed if the Generator is
+// configured to do so), and an optional checksum trailer.
+type Framing struct {
+	Length   bool     // Prefix the payload with its length in bytes, as a big endian uint32.
+	Checksum Checksum // Append a checksum of the payload.
+}
+
+const frameLengthSize = 4
+
+// frame writes the frame header to buf, then the payload produced by the provided func, and then the trailer.
+func (f Framing) frame(buf *bytes.Buffer, payload func(io.Writer) error) error {
+	var hdr [frameLengthSize]byte
+	if f.Length {
+		buf.Write(hdr[:])
+	}
+	beg := buf.Len()
+
+	if err := payload(buf); err != nil {
+		return err
+	}
+
+	b := buf.Bytes()
+	if f.Length {
+		if int64(len(b)-beg) > math.MaxUint32 {
+			return errors.Errorf("frame payload of %d bytes is too large", len(b)-beg)
+		}
+		binary.BigEndian.PutUint32(b[beg-frameLengthSize:], uint32(len(b)-beg))
+	}
+
+	var sum [sha256.Size]byte
+	buf.Write(f.Checksum.sum(sum[:0], b[beg:]))
+	return nil
+}
+
+// unframe reads a single frame from r into buf, which is reset first, and verifies its checksum. On success buf holds
+// only the payload. If the frame has no length prefix, r is read until io.EOF. Otherwise, if max is positive, a frame
+// declaring a payload longer than max bytes fails with a LimitError before any of it is read.
+func (f Framing) unframe(r io.Reader, buf *bytes.Buffer, max int) error {
+	buf.Reset()
+
+	if !f.Length {
+		if _, err := buf.ReadFrom(r); err != nil {
+			return errors.Wrap(err, "read frame")
+		}
+		if buf.Len() < f.Checksum.size() {
+			return errors.Wrap(io.ErrUnexpectedEOF, "read frame")
+		}
+	} else {
+		var hdr [frameLengthSize]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			return errors.Wrap(err, "read frame length")
+		}
+		l := int64(binary.BigEndian.Uint32(hdr[:]))
+		if max > 0 && l > int64(max) {
+			return LimitError{"frame size", max, 0}
+		}
+		// We let the buffer grow as data arrives, rather than trusting the declared length up front.
+		n := l + int64(f.Checksum.size())
+		if _, err := io.CopyN(buf, r, n); err == io.EOF {
+			return errors.Wrap(io.ErrUnexpectedEOF, "read frame")
+		} else if err != nil {
+			return errors.Wrap(err, "read frame")
+		}
+	}
+
+	n := buf.Len() - f.Checksum.size()
+	b := buf.Bytes()
+	var sum [sha256.Size]byte
+	if !bytes.Equal(f.Checksum.sum(sum[:0], b[:n]), b[n:]) {
+		return ErrChecksumMismatch
+	}
+	buf.Truncate(n)
+	return nil
+}
+
+// UnwrapFrame reads a single frame as described by f from r, verifies its checksum, and returns a reader of the payload
+// that can be handed to a Parser (or NewDecompressor, if the payload was compressed). If f has no length prefix, the
+// frame is assumed to extend to the end of r.
+func UnwrapFrame(r io.Reader, f Framing) (io.Reader, error) {
+	if f == (Framing{}) {
+		return r, nil
+	}
+
+	var buf bytes.Buffer
+	if err := f.unframe(r, &buf, 0); err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(buf.Bytes()), nil
+}
+
+// A FrameReader reads a sequence of length prefixed Marshal streams from a long-lived io.Reader, such as a network
+// connection. Buffers and the Parser are reused across frames.
+type FrameReader struct {
+	r   io.Reader
+	f   Framing
+	buf bytes.Buffer
+	br  bytes.Reader
+	p   *Parser
+	max int
+}
+
+// NewFrameReader returns a FrameReader that reads frames with a length prefix and the given checksum trailer from r.
+func NewFrameReader(r io.Reader, checksum Checksum) *FrameReader {
+	return &FrameReader{r: r, f: Framing{Length: true, Checksum: checksum}}
+}
+
+// SetMaxFrameSize limits the size of the payload of each frame. Since a frame is read in its entirety before it's
+// parsed, a hostile peer could otherwise declare frames of up to 4GiB. Next returns a LimitError for a frame whose length
+// prefix exceeds the limit, without reading the rest of the frame, so the FrameReader can't be used after that. A limit
+// of 0 (the default) means no limit.
+func (fr *FrameReader) SetMaxFrameSize(n int) {
+	fr.max = n
+}
+
+// Next reads the next frame in its entirety, verifies its checksum, and returns a Parser that is ready to read the
+// Marshal stream it contains. The same Parser is returned for every frame, so the previous frame must be finished with
+// before calling Next again. Next returns io.EOF when r ends cleanly between frames.
+func (fr *FrameReader) Next() (*Parser, error) {
+	if err := fr.f.unframe(fr.r, &fr.buf, fr.max); err != nil {
+		if errors.Cause(err) == io.EOF {
+			return nil, io.EOF
+		}
+		return nil, err
+	}
+
+	fr.br.Reset(fr.buf.Bytes())
+	if fr.p == nil {
+		fr.p = NewParser(&fr.br)
+	} else {
+		fr.p.Reset(&fr.br)
+	}
+	return fr.p, nil
+}
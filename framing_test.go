@@ -0,0 +1,172 @@
+package rmarsh_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/samcday/rmarsh"
+)
+
+func TestFramingRoundTrip(t *testing.T) {
+	framings := []rmarsh.Framing{
+		{Length: true},
+		{Checksum: rmarsh.ChecksumCRC32},
+		{Checksum: rmarsh.ChecksumSHA256},
+		{Length: true, Checksum: rmarsh.ChecksumCRC32},
+		{Length: true, Checksum: rmarsh.ChecksumSHA256},
+	}
+
+	for _, f := range framings {
+		for _, c := range []rmarsh.Compression{rmarsh.CompressionNone, rmarsh.CompressionZlib} {
+			b := new(bytes.Buffer)
+			gen := rmarsh.NewGenerator(b)
+			gen.SetFraming(f)
+			gen.SetCompression(c)
+			if err := gen.Symbol("test"); err != nil {
+				t.Fatal(err)
+			}
+
+			r, err := rmarsh.UnwrapFrame(bytes.NewReader(b.Bytes()), f)
+			if err != nil {
+				t.Fatalf("Framing %+v: %s", f, err)
+			}
+			if r, err = rmarsh.NewDecompressor(r); err != nil {
+				t.Fatal(err)
+			}
+			p := rmarsh.NewParser(r)
+			sym, _ := expectToken(t, p, rmarsh.TokenSymbol)
+			if string(sym) != "test" {
+				t.Fatalf("Framing %+v: read symbol %q, expected test", f, sym)
+			}
+			expectToken(t, p, rmarsh.TokenEOF)
+		}
+	}
+}
+
+func TestFramingLayout(t *testing.T) {
+	b := new(bytes.Buffer)
+	gen := rmarsh.NewGenerator(b)
+	gen.SetFraming(rmarsh.Framing{Length: true, Checksum: rmarsh.ChecksumCRC32})
+	if err := gen.Nil(); err != nil {
+		t.Fatal(err)
+	}
+
+	// CRC-32 of 0x04 0x08 0x30.
+	exp := []byte{0x00, 0x00, 0x00, 0x03, 0x04, 0x08, '0', 0x16, 0x48, 0xCB, 0x6A}
+	if !bytes.Equal(b.Bytes(), exp) {
+		t.Fatalf("Generated %x, expected %x", b.Bytes(), exp)
+	}
+}
+
+func TestUnwrapFrameChecksumMismatch(t *testing.T) {
+	f := rmarsh.Framing{Length: true, Checksum: rmarsh.ChecksumSHA256}
+	b := new(bytes.Buffer)
+	gen := rmarsh.NewGenerator(b)
+	gen.SetFraming(f)
+	if err := gen.Fixnum(123); err != nil {
+		t.Fatal(err)
+	}
+
+	raw := b.Bytes()
+	raw[6]++
+	if _, err := rmarsh.UnwrapFrame(bytes.NewReader(raw), f); err != rmarsh.ErrChecksumMismatch {
+		t.Fatalf("Unexpected error %+v", err)
+	}
+}
+
+func TestUnwrapFrameTruncated(t *testing.T) {
+	f := rmarsh.Framing{Length: true, Checksum: rmarsh.ChecksumCRC32}
+	raw := []byte{0x00, 0x00, 0x00, 0x03, 0x04, 0x08, '0', 0x16}
+	if _, err := rmarsh.UnwrapFrame(bytes.NewReader(raw), f); err == nil {
+		t.Fatal("Expected error")
+	}
+}
+
+func TestFrameReader(t *testing.T) {
+	b := new(bytes.Buffer)
+	gen := rmarsh.NewGenerator(b)
+	gen.SetFraming(rmarsh.Framing{Length: true, Checksum: rmarsh.ChecksumCRC32})
+	syms := []string{"foo", "bar", "baz"}
+	for _, sym := range syms {
+		gen.Reset(nil)
+		if err := gen.Symbol(sym); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fr := rmarsh.NewFrameReader(bytes.NewReader(b.Bytes()), rmarsh.ChecksumCRC32)
+	for _, exp := range syms {
+		p, err := fr.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		sym, _ := expectToken(t, p, rmarsh.TokenSymbol)
+		if string(sym) != exp {
+			t.Fatalf("Read symbol %q, expected %q", sym, exp)
+		}
+		expectToken(t, p, rmarsh.TokenEOF)
+	}
+	if _, err := fr.Next(); err != io.EOF {
+		t.Fatalf("Unexpected error %+v", err)
+	}
+}
+
+func TestFrameReaderTruncated(t *testing.T) {
+	raw := []byte{0x00, 0x00, 0x00, 0x03, 0x04, 0x08}
+	if _, err := rmarsh.NewFrameReader(bytes.NewReader(raw), rmarsh.ChecksumNone).Next(); err == nil || err == io.EOF {
+		t.Fatalf("Unexpected error %+v", err)
+	}
+}
+
+func TestFrameReaderMaxFrameSize(t *testing.T) {
+	// Frames of :a (5 bytes) and :abc (7 bytes).
+	raw := []byte{0x00, 0x00, 0x00, 0x05, 0x04, 0x08, ':', 0x06, 'a'}
+	raw = append(raw, 0x00, 0x00, 0x00, 0x07, 0x04, 0x08, ':', 0x08, 'a', 'b', 'c')
+	fr := rmarsh.NewFrameReader(bytes.NewReader(raw), rmarsh.ChecksumNone)
+	fr.SetMaxFrameSize(5)
+
+	p, err := fr.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectToken(t, p, rmarsh.TokenSymbol)
+	_, err = fr.Next()
+	if lerr, ok := err.(rmarsh.LimitError); !ok || lerr.Limit != "frame size" || lerr.Max != 5 {
+		t.Fatalf("Unexpected error %+v", err)
+	}
+	if !errors.Is(err, rmarsh.ErrLimitExceeded) {
+		t.Errorf("Error %v is not ErrLimitExceeded", err)
+	}
+
+	// A frame declaring 4GiB is refused without waiting for it to arrive.
+	fr = rmarsh.NewFrameReader(bytes.NewReader([]byte{0xFF, 0xFF, 0xFF, 0xFF}), rmarsh.ChecksumNone)
+	fr.SetMaxFrameSize(1 << 20)
+	if _, err := fr.Next(); !errors.Is(err, rmarsh.ErrLimitExceeded) {
+		t.Fatalf("Unexpected error %+v", err)
+	}
+}
+
+func BenchmarkFrameReader(b *testing.B) {
+	buf := new(bytes.Buffer)
+	gen := rmarsh.NewGenerator(buf)
+	gen.SetFraming(rmarsh.Framing{Length: true})
+	if err := gen.Symbol("test"); err != nil {
+		b.Fatal(err)
+	}
+	r := newCyclicReader(buf.Bytes())
+	fr := rmarsh.NewFrameReader(r, rmarsh.ChecksumNone)
+
+	for i := 0; i < b.N; i++ {
+		p, err := fr.Next()
+		if err != nil {
+			b.Fatal(err)
+		}
+		if tok, _, _, err := p.Read(); err != nil {
+			b.Fatal(err)
+		} else if tok != rmarsh.TokenSymbol {
+			b.Fatalf("Unexpected token %s", tok)
+		}
+	}
+}
@@ -1,11 +1,15 @@
 package rmarsh
 
 import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
 	"fmt"
 	"io"
 	"math"
 	"math/big"
 	"strconv"
+	"unicode/utf8"
 
 	"github.com/pkg/errors"
 )
@@ -21,6 +25,18 @@ var ErrGeneratorOverflow = fmt.Errorf("Write past end of bounded array/hash/ivar
 // be the next value. This expectation is enforced when writing the keys of an ivar, struct and object.
 var ErrNonSymbolValue = fmt.Errorf("Non Symbol value written when Symbol expected")
 
+// ErrInvalidUTF8 is the error returned when a String containing invalid UTF-8 is marked with the UTF-8 encoding, and the
+// Generator has been configured to fail in this situation with SetUTF8Policy.
+var ErrInvalidUTF8 = fmt.Errorf("String marked as UTF-8 contains invalid sequences")
+
+// ErrUnsafeValue is the error returned when a Generator restricted to the safe subset with SetSafeSubset is asked to
+// write an object, struct, user defined or user marshalled type, class or module.
+var ErrUnsafeValue = fmt.Errorf("Value not permitted in safe subset")
+
+// ErrDuplicateHashKey is the error returned when a hash key is written that is identical to one already written in the
+// same hash. This is only checked if the Generator has been configured with SetUniqueHashKeys.
+var ErrDuplicateHashKey = fmt.Errorf("Duplicate key written to hash")
+
 const (
 	genStateGrowSize = 8 // Initial size + amount to grow state stack by
 	symTblGrowSize   = 8
@@ -37,8 +53,34 @@ type Generator struct {
 
 	symCount int
 	symTbl   []string
+
+	compression Compression
+	cw          compressor
+	framing     Framing
+	fbuf        bytes.Buffer
+
+	uniqueKeys bool
+	checkSyms  bool
+	utf8       UTF8Policy
+	sym        string // The most recent Symbol written.
+	maxOut     int
+	safe       bool
+
+	stats statsTracker
 }
 
+// UTF8Policy controls what a Generator does when a String containing invalid UTF-8 is marked as UTF-8, by wrapping it in
+// an IVar with an E=true instance variable.
+type UTF8Policy uint8
+
+// The available UTF-8 policies.
+const (
+	UTF8Ignore  UTF8Policy = iota // Write the String as is. Ruby will load it, but operations on it may fail.
+	UTF8Fail                      // Reject the write of the E=true instance variable with ErrInvalidUTF8.
+	UTF8Replace                   // Replace each invalid byte with the Unicode replacement character U+FFFD.
+	UTF8Binary                    // Leave the String untouched, but mark it as binary (ASCII-8BIT) instead of UTF-8.
+)
+
 // NewGenerator returns a new Generator that is ready to start writing out a Ruby Marshal stream. Generators are not
 // thread safe, but can be reused for new Marshal streams by calling Reset().
 func NewGenerator(w io.Writer) *Generator {
@@ -63,12 +105,78 @@ func (gen *Generator) Reset(w io.Writer) {
 
 	gen.c = 0
 	gen.symCount = 0
+	gen.stats.reset()
 
 	gen.buf[0] = 0x04
 	gen.buf[1] = 0x08
 	gen.bufn = 2
 }
 
+// SetCompression configures the Generator to compress each completed Marshal stream with the given format before it is
+// written to the underlying io.Writer. The resulting output can be loaded in Ruby with Zlib::Inflate.inflate (or
+// Zlib::GzipReader) followed by Marshal.load, and can be read back by a Parser via NewDecompressor.
+func (gen *Generator) SetCompression(c Compression) {
+	if c != gen.compression {
+		gen.cw = nil
+	}
+	gen.compression = c
+}
+
+// SetFraming configures the Generator to wrap each completed Marshal stream in a frame before it is written to the
+// underlying io.Writer. If compression is also configured, the compressed stream is framed. Frames can be unwrapped with
+// UnwrapFrame, or read one after the other with a FrameReader.
+func (gen *Generator) SetFraming(f Framing) {
+	gen.framing = f
+}
+
+// SetUniqueHashKeys configures the Generator to track the keys written to each hash, and reject any key that duplicates
+// an earlier one with ErrDuplicateHashKey. Ruby silently keeps the last value written for a duplicated key, which is
+// rarely what a buggy caller intended. Keys are compared by their encoded form, so the rejected key is discarded and a
+// different key can be written in its place.
+// Note that Symbols nested inside complex keys (such as an Array) are encoded as symlinks after their first use, so two
+// such keys may not be recognized as duplicates.
+func (gen *Generator) SetUniqueHashKeys(b bool) {
+	gen.uniqueKeys = b
+}
+
+// SetSafeSubset restricts the Generator to the plain data types: nil, booleans, numbers, symbols, strings, regexps,
+// arrays, hashes and ivars. Attempts to write anything that names a class (objects, structs, user defined and user
+// marshalled types, classes and modules) fail with ErrUnsafeValue. This guarantees that the output can be loaded by Ruby
+// readers that enforce strict safe loading policies.
+func (gen *Generator) SetSafeSubset(b bool) {
+	gen.safe = b
+}
+
+// SetStatsHook configures a hook that receives Stats for each Marshal stream the Generator writes. The hook is called
+// once the stream has been flushed to the underlying io.Writer, or if the stream is aborted because flushing failed or
+// a limit was exceeded. Passing nil removes the hook.
+func (gen *Generator) SetStatsHook(h StatsHook) {
+	gen.stats.hook = h
+}
+
+// SetMaxOutputBytes limits the size of the Marshal streams the Generator will write, for callers that need to fit
+// within the value size limit of a cache store. The size of the stream is checked as each value is completed. Once it
+// exceeds n bytes, the write fails with a LimitError reporting the size of the stream so far, and nothing is written to
+// the underlying io.Writer. The value that exceeded the limit is not rolled back, so the Generator must be Reset before
+// it's used again. The limit applies to the uncompressed and unframed stream, including the magic header. A limit of 0
+// (the default) means no limit.
+func (gen *Generator) SetMaxOutputBytes(n int) {
+	gen.maxOut = n
+}
+
+// SetUTF8Policy configures how the Generator handles Strings that are marked as UTF-8 but don't contain valid UTF-8.
+// The default is UTF8Ignore. Only a String written as the value of an IVar is checked, and only when an E=true instance
+// variable is written for it.
+func (gen *Generator) SetUTF8Policy(p UTF8Policy) {
+	gen.utf8 = p
+}
+
+// SetSymbolValidation controls whether the Generator checks symbols and class names with IsValidSymbol before writing
+// them, failing with ErrInvalidSymbol if they're not valid. Validation is disabled by default.
+func (gen *Generator) SetSymbolValidation(b bool) {
+	gen.checkSyms = b
+}
+
 // Nil writes the nil value to the Marshal stream.
 func (gen *Generator) Nil() error {
 	if err := gen.checkState(false, 1); err != nil {
@@ -180,8 +288,23 @@ func (gen *Generator) Bignum(b *big.Int) error {
 	return gen.writeAdv()
 }
 
+// The number of bytes needed to wrap a symbol in an ivar marking it as UTF-8: the ivar type and count, the E symbol (or a
+// symlink to it), and true.
+const symUTF8Sz = 3 + 1 + fixnumMaxBytes
+
+// symSize returns the most bytes writeSym needs to write sym.
+func symSize(sym string) int {
+	sz := 1 + fixnumMaxBytes + len(sym)
+	if symUTF8(sym) {
+		sz += symUTF8Sz
+	}
+	return sz
+}
+
 // Writes given symbol (or a symlink if symbol already written before) but does not check state or advance write state.
 // Intended to be used where symbols are embedded in other value types (like StartObject)
+// The first time a symbol with non-ASCII characters is written, it's wrapped in an ivar marking it as UTF-8, as Ruby
+// does. Otherwise Ruby would load it as a binary Symbol, distinct from the one spelled the same way in Ruby source.
 func (gen *Generator) writeSym(sym string) {
 	if l := len(gen.symTbl); l == 0 || l == gen.symCount {
 		newTbl := make([]string, l+symTblGrowSize)
@@ -198,6 +321,12 @@ func (gen *Generator) writeSym(sym string) {
 		}
 	}
 
+	enc := symUTF8(sym)
+	if enc {
+		gen.buf[gen.bufn] = typeIvar
+		gen.bufn++
+	}
+
 	l := len(sym)
 	gen.buf[gen.bufn] = typeSymbol
 	gen.bufn++
@@ -207,21 +336,44 @@ func (gen *Generator) writeSym(sym string) {
 
 	gen.symTbl[gen.symCount] = sym
 	gen.symCount++
+
+	if enc {
+		gen.encodeLong(1)
+		gen.writeSym("E")
+		gen.buf[gen.bufn] = typeTrue
+		gen.bufn++
+	}
 }
 
 // Symbol writes a Ruby symbol value to the Marshal stream.
 // The generator automatically handles writing "symlink" values to the stream if the symbol name has already been
-// written in this Marshal stream.
+// written in this Marshal stream. A name containing non-ASCII characters is marked as UTF-8 if it's valid UTF-8.
 func (gen *Generator) Symbol(sym string) error {
-	if err := gen.checkState(true, 1+fixnumMaxBytes+len(sym)); err != nil {
+	if err := gen.checkSym(sym); err != nil {
+		return err
+	}
+	if err := gen.checkState(true, symSize(sym)); err != nil {
 		return err
 	}
 
 	gen.writeSym(sym)
+	gen.sym = sym
 
 	return gen.writeAdv()
 }
 
+// SymbolBytes is like Symbol, but takes the name of the symbol as a byte slice, such as one returned by Parser.Read.
+// The name is only copied into a string the first time it's written to the stream, so writing a symbol that's already
+// been written does not allocate.
+func (gen *Generator) SymbolBytes(sym []byte) error {
+	for i := 0; i < gen.symCount; i++ {
+		if gen.symTbl[i] == string(sym) {
+			return gen.Symbol(gen.symTbl[i])
+		}
+	}
+	return gen.Symbol(string(sym))
+}
+
 // Writes given string to stream but does not check state or advance it.
 func (gen *Generator) writeString(str string) {
 	l := len(str)
@@ -245,6 +397,39 @@ func (gen *Generator) String(str string) error {
 	return gen.writeAdv()
 }
 
+// utf8String writes a String with UTF-8 encoding, as most Strings created in Ruby are.
+func (gen *Generator) utf8String(s string) error {
+	if err := gen.StartIVar(1); err != nil {
+		return err
+	}
+	if err := gen.String(s); err != nil {
+		return err
+	}
+	if err := gen.Symbol("E"); err != nil {
+		return err
+	}
+	if err := gen.Bool(true); err != nil {
+		return err
+	}
+	return gen.EndIVar()
+}
+
+// StringBytes is like String, but takes the contents of the string as a byte slice. It does not allocate.
+func (gen *Generator) StringBytes(str []byte) error {
+	l := len(str)
+	if err := gen.checkState(false, 1+fixnumMaxBytes+l); err != nil {
+		return err
+	}
+
+	gen.buf[gen.bufn] = typeString
+	gen.bufn++
+	gen.encodeLong(int64(l))
+	copy(gen.buf[gen.bufn:], str)
+	gen.bufn += l
+
+	return gen.writeAdv()
+}
+
 // Float writes the given float value to the Marshal stream.
 func (gen *Generator) Float(f float64) error {
 	// String repr of a float64 will never exceed 30 chars.
@@ -324,6 +509,9 @@ func (gen *Generator) EndHash() error {
 
 // Class writes a Ruby class reference to the Marshal stream.
 func (gen *Generator) Class(name string) error {
+	if gen.safe {
+		return ErrUnsafeValue
+	}
 	l := len(name)
 	if err := gen.checkState(false, 1+fixnumMaxBytes+l); err != nil {
 		return err
@@ -340,6 +528,9 @@ func (gen *Generator) Class(name string) error {
 
 // Module writes a Ruby module reference to the Marshal stream.
 func (gen *Generator) Module(name string) error {
+	if gen.safe {
+		return ErrUnsafeValue
+	}
 	l := len(name)
 	if err := gen.checkState(false, 1+fixnumMaxBytes+l); err != nil {
 		return err
@@ -388,9 +579,15 @@ func (gen *Generator) EndIVar() error {
 // StartObject begins writing an object with provided class name to the Marshal stream.
 // The next calls must be l pairs of Symbol+<any> calls.
 func (gen *Generator) StartObject(name string, l int) error {
+	if gen.safe {
+		return ErrUnsafeValue
+	}
 	// Need enough space for the two type bytes (object + symbol), the encoded length of the symbol, and the encoded
 	// length of the object variables.
-	if err := gen.checkState(false, 1+1+fixnumMaxBytes+len(name)+fixnumMaxBytes); err != nil {
+	if err := gen.checkSym(name); err != nil {
+		return err
+	}
+	if err := gen.checkState(false, 1+symSize(name)+fixnumMaxBytes); err != nil {
 		return err
 	}
 	gen.buf[gen.bufn] = typeObject
@@ -422,7 +619,13 @@ func (gen *Generator) EndObject() error {
 // The next call can be any value type.
 // UserMarshalled object state must be completed with a call to EndUserMarshalled().
 func (gen *Generator) StartUserMarshalled(name string) error {
-	if err := gen.checkState(false, 1+1+fixnumMaxBytes+len(name)); err != nil {
+	if gen.safe {
+		return ErrUnsafeValue
+	}
+	if err := gen.checkSym(name); err != nil {
+		return err
+	}
+	if err := gen.checkState(false, 1+symSize(name)); err != nil {
 		return err
 	}
 	gen.buf[gen.bufn] = typeUsrMarshal
@@ -451,7 +654,13 @@ func (gen *Generator) EndUserMarshalled() error {
 // User defined objects are Ruby objects that have a _load function that accepts a string and construct the object.
 // If you need to specify encoding on the data string, open an IVar context with StartIVar before calling this method.
 func (gen *Generator) UserDefinedObject(name, data string) error {
-	if err := gen.checkState(false, 1+fixnumMaxBytes+len(name)+fixnumMaxBytes+len(data)); err != nil {
+	if gen.safe {
+		return ErrUnsafeValue
+	}
+	if err := gen.checkSym(name); err != nil {
+		return err
+	}
+	if err := gen.checkState(false, 1+symSize(name)+fixnumMaxBytes+len(data)); err != nil {
 		return err
 	}
 	gen.buf[gen.bufn] = typeUsrDef
@@ -486,7 +695,13 @@ func (gen *Generator) Regexp(expr string, flags byte) error {
 // StartStruct begins writing a struct value to the Marshal stream.
 // l pairs of Symbol + values must be written after this call, and then punctuated with a call to EndStruct
 func (gen *Generator) StartStruct(name string, l int) error {
-	if err := gen.checkState(false, 1+1+fixnumMaxBytes+len(name)+fixnumMaxBytes); err != nil {
+	if gen.safe {
+		return ErrUnsafeValue
+	}
+	if err := gen.checkSym(name); err != nil {
+		return err
+	}
+	if err := gen.checkState(false, 1+symSize(name)+fixnumMaxBytes); err != nil {
 		return err
 	}
 	gen.buf[gen.bufn] = typeStruct
@@ -513,7 +728,18 @@ func (gen *Generator) EndStruct() error {
 	return gen.writeAdv()
 }
 
+func (gen *Generator) checkSym(sym string) error {
+	if gen.checkSyms && !IsValidSymbol(sym) {
+		return ErrInvalidSymbol
+	}
+	return nil
+}
+
 func (gen *Generator) checkState(isSym bool, sz int) error {
+	if gen.stats.hook != nil {
+		gen.stats.begin()
+	}
+
 	// Make sure we're not writing past bounds.
 	if gen.st.cur.pos == gen.st.cur.cnt {
 		if gen.st.sz == 1 {
@@ -522,6 +748,21 @@ func (gen *Generator) checkState(isSym bool, sz int) error {
 		return ErrGeneratorOverflow
 	}
 
+	if gen.uniqueKeys && gen.st.cur.typ == genStHash && gen.st.cur.pos&1 == 0 {
+		gen.st.cur.keyBeg = gen.bufn
+	}
+
+	if gen.utf8 != UTF8Ignore && gen.st.cur.typ == genStIVar {
+		switch cur := gen.st.cur; {
+		case cur.pos == -1:
+			cur.valBeg = gen.bufn
+		case cur.pos&1 == 0:
+			cur.keyBeg = gen.bufn
+		default:
+			cur.keyEnd = gen.bufn
+		}
+	}
+
 	if gen.st.cur.typ == genStIVar && gen.st.cur.pos == -1 {
 		// We're gonna be writing the IVar length after this next value during writeAdv.
 		// So, make sure the buffer size will be big enough to accommodate that also.
@@ -535,6 +776,12 @@ func (gen *Generator) checkState(isSym bool, sz int) error {
 		}
 	}
 
+	gen.grow(sz)
+	return nil
+}
+
+// Makes sure there's room in the buffer to write sz more bytes.
+func (gen *Generator) grow(sz int) {
 	if len(gen.buf) < gen.bufn+sz {
 		newBuf := make([]byte, gen.bufn+sz)
 		if gen.bufn > 0 {
@@ -542,24 +789,49 @@ func (gen *Generator) checkState(isSym bool, sz int) error {
 		}
 		gen.buf = newBuf
 	}
-
-	return nil
 }
 
 // Writes the given bytes if provided, then advances current state of the generator.
 func (gen *Generator) writeAdv() error {
+	if gen.maxOut > 0 && gen.bufn > gen.maxOut {
+		err := LimitError{"output size", gen.maxOut, gen.bufn}
+		if gen.stats.hook != nil {
+			gen.stats.finish(gen.bufn, err)
+		}
+		return err
+	}
+	gen.stats.tokens++
+
 	gen.st.cur.pos++
 
 	if gen.st.cur.typ == genStIVar && gen.st.cur.pos == 0 {
+		gen.st.cur.strEnd = gen.bufn
+
 		// If we just reached pos 0 for the current ivar, it means we wrote the main value and we're about to start
 		// on the instnace vars themselves. We need to write out the instance var count now.
 		gen.encodeLong(int64(gen.st.cur.cnt / 2))
 	}
 
+	if gen.utf8 != UTF8Ignore && gen.st.cur.typ == genStIVar && gen.st.cur.pos > 0 {
+		if err := gen.checkIVarUTF8(); err != nil {
+			return err
+		}
+	}
+
+	if gen.uniqueKeys && gen.st.cur.typ == genStHash && gen.st.cur.pos&1 == 1 {
+		if err := gen.checkKey(); err != nil {
+			return err
+		}
+	}
+
 	// If we've just finished writing out the last value, then we make sure to flush anything remaining.
 	// Otherwise, we let things accumulate in our small buffer between calls to reduce the number of writes.
 	if gen.bufn > 0 && gen.st.cur.pos == gen.st.cur.cnt && gen.st.sz == 1 {
-		if _, err := gen.w.Write(gen.buf[:gen.bufn]); err != nil {
+		err := gen.flush()
+		if gen.stats.hook != nil {
+			gen.stats.finish(gen.bufn, err)
+		}
+		if err != nil {
 			return err
 		}
 		gen.c += gen.bufn
@@ -569,36 +841,136 @@ func (gen *Generator) writeAdv() error {
 	return nil
 }
 
-func (gen *Generator) encodeLong(n int64) {
-	if n == 0 {
-		gen.buf[gen.bufn] = 0
-		gen.bufn++
-		return
-	} else if 0 < n && n < 0x7B {
-		gen.buf[gen.bufn] = byte(n + 5)
-		gen.bufn++
-		return
-	} else if -0x7C < n && n < 0 {
-		gen.buf[gen.bufn] = byte((n - 5) & 0xFF)
-		gen.bufn++
-		return
+// Writes out the buffered Marshal stream, compressing and framing it first if the Generator has been configured to do so.
+func (gen *Generator) flush() error {
+	if gen.framing == (Framing{}) {
+		return gen.writeStream(gen.w)
 	}
 
-	for i := 1; i < 5; i++ {
-		gen.buf[gen.bufn+i] = byte(n & 0xFF)
-		n = n >> 8
-		if n == 0 {
-			gen.buf[gen.bufn] = byte(i)
-			gen.bufn += i + 1
-			return
+	gen.fbuf.Reset()
+	if err := gen.framing.frame(&gen.fbuf, gen.writeStream); err != nil {
+		return err
+	}
+	_, err := gen.w.Write(gen.fbuf.Bytes())
+	return err
+}
+
+// Writes the buffered Marshal stream to w, compressing it if necessary.
+func (gen *Generator) writeStream(w io.Writer) error {
+	if gen.compression == CompressionNone {
+		_, err := w.Write(gen.buf[:gen.bufn])
+		return err
+	}
+
+	if gen.cw == nil {
+		if gen.compression == CompressionGzip {
+			gen.cw = gzip.NewWriter(w)
+		} else {
+			gen.cw = zlib.NewWriter(w)
 		}
-		if n == -1 {
-			gen.buf[gen.bufn] = byte(-i)
-			gen.bufn += i + 1
-			return
+	} else {
+		gen.cw.Reset(w)
+	}
+
+	if _, err := gen.cw.Write(gen.buf[:gen.bufn]); err != nil {
+		return errors.Wrap(err, "compress")
+	}
+	return errors.Wrap(gen.cw.Close(), "compress")
+}
+
+// Checks the hash key that was just written against the other keys of the current hash. Duplicate keys are discarded.
+func (gen *Generator) checkKey() error {
+	cur := gen.st.cur
+	key := gen.buf[cur.keyBeg:gen.bufn]
+
+	// A Symbol key is written in full the first time the Symbol is seen, and as a symlink after that. So we always
+	// compare the symlink form. If the key was written in full, it was the most recent addition to the symbol table.
+	var b [1 + fixnumMaxBytes]byte
+	if key[0] == typeSymbol {
+		b[0] = typeSymlink
+		key = b[:1+putLong(b[1:], int64(gen.symCount-1))]
+	}
+
+	if cur.keys == nil {
+		cur.keys = make(map[string]struct{})
+	}
+	if _, ok := cur.keys[string(key)]; ok {
+		gen.bufn = cur.keyBeg
+		cur.pos--
+		return ErrDuplicateHashKey
+	}
+	cur.keys[string(key)] = struct{}{}
+	return nil
+}
+
+// Checks the ivar that was just written. If it's an E=true wrapping a String, the String is handled according to the
+// UTF-8 policy.
+func (gen *Generator) checkIVarUTF8() error {
+	cur := gen.st.cur
+	if gen.buf[cur.valBeg] != typeString {
+		return nil
+	}
+	if cur.pos&1 == 1 {
+		cur.eKey = gen.sym == "E"
+		return nil
+	}
+	if !cur.eKey || gen.bufn != cur.keyEnd+1 || gen.buf[cur.keyEnd] != typeTrue {
+		return nil
+	}
+
+	// Find where the String data begins, by skipping over the encoded length.
+	lenBeg := cur.valBeg + 1
+	_, sz := getLong(gen.buf[lenBeg:cur.strEnd])
+	beg := lenBeg + sz
+	data := gen.buf[beg:cur.strEnd]
+	if utf8.Valid(data) {
+		return nil
+	}
+
+	switch gen.utf8 {
+	case UTF8Fail:
+		gen.bufn = cur.keyEnd
+		cur.pos--
+		return ErrInvalidUTF8
+
+	case UTF8Replace:
+		var fixed []byte
+		for len(data) > 0 {
+			r, sz := utf8.DecodeRune(data)
+			if r == utf8.RuneError && sz == 1 {
+				fixed = append(fixed, "\uFFFD"...)
+			} else {
+				fixed = append(fixed, data[:sz]...)
+			}
+			data = data[sz:]
 		}
+		// Everything after the String (ivar count and ivars so far) needs to be moved along.
+		tail := append([]byte(nil), gen.buf[cur.strEnd:gen.bufn]...)
+
+		gen.bufn = lenBeg
+		gen.grow(fixnumMaxBytes + len(fixed) + len(tail))
+		gen.encodeLong(int64(len(fixed)))
+		gen.bufn += copy(gen.buf[gen.bufn:], fixed)
+		gen.bufn += copy(gen.buf[gen.bufn:], tail)
+
+	case UTF8Binary:
+		// We can't remove the instance variable since the count has already been written. Instead, it's replaced with
+		// an explicit encoding. If the E key was the first use of that Symbol, it's no longer needed in the table.
+		if gen.buf[cur.keyBeg] == typeSymbol {
+			gen.symCount--
+		}
+		gen.bufn = cur.keyBeg
+		gen.grow(1 + fixnumMaxBytes + len("encoding") + 1 + fixnumMaxBytes + len("ASCII-8BIT"))
+		gen.writeSym("encoding")
+		gen.buf[gen.bufn] = typeString
+		gen.bufn++
+		gen.writeString("ASCII-8BIT")
 	}
-	panic("Shouldn't *ever* reach here")
+	return nil
+}
+
+func (gen *Generator) encodeLong(n int64) {
+	gen.bufn += putLong(gen.buf[gen.bufn:], n)
 }
 
 const (
@@ -615,12 +987,24 @@ type genStateItem struct {
 	cnt int
 	pos int
 	typ uint8
+
+	keyBeg int                 // Offset in the buffer of the hash or ivar key currently being written.
+	keys   map[string]struct{} // Encoded keys written to the hash so far, if unique keys are being enforced.
+
+	// These track the value wrapped by an ivar, and its instance variables, to enforce the UTF-8 policy.
+	valBeg int  // Offset in the buffer of the wrapped value.
+	strEnd int  // Offset in the buffer of the end of the wrapped value.
+	keyEnd int  // Offset in the buffer of the instance variable value currently being written.
+	eKey   bool // Set if the current instance variable is E.
 }
 
 func (st *genStateItem) reset(sz int, typ uint8) {
 	st.cnt = sz
 	st.pos = 0
 	st.typ = typ
+	for k := range st.keys {
+		delete(st.keys, k)
+	}
 }
 
 type genState struct {
@@ -7,7 +7,9 @@ import (
 	"io/ioutil"
 	"math/big"
 	"testing"
+	"time"
 
+	"github.com/pkg/errors"
 	"github.com/samcday/rmarsh"
 )
 
@@ -24,6 +26,15 @@ func testGenerator(t *testing.T, exp string, f func(gen *rmarsh.Generator) error
 	}
 }
 
+// genStream returns the Marshal stream written by f.
+func genStream(t testing.TB, f func(gen *rmarsh.Generator) error) []byte {
+	b := new(bytes.Buffer)
+	if err := f(rmarsh.NewGenerator(b)); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
 func TestGenNil(t *testing.T) {
 	testGenerator(t, "nil", func(gen *rmarsh.Generator) error {
 		return gen.Nil()
@@ -138,6 +149,57 @@ func TestGenSymbol(t *testing.T) {
 	})
 }
 
+func TestGenSymbolInvalid(t *testing.T) {
+	for _, sym := range []string{"", "a\x00b", "\xFFbad"} {
+		if rmarsh.IsValidSymbol(sym) {
+			t.Errorf("IsValidSymbol(%q) = true", sym)
+		}
+		gen := rmarsh.NewGenerator(ioutil.Discard)
+		if err := gen.Symbol(sym); err != nil {
+			t.Errorf("Symbol(%q) without validation: unexpected error %+v", sym, err)
+		}
+
+		gen.Reset(nil)
+		gen.SetSymbolValidation(true)
+		if err := gen.Symbol(sym); err != rmarsh.ErrInvalidSymbol {
+			t.Errorf("Symbol(%q): unexpected error %+v", sym, err)
+		}
+		if err := gen.SymbolBytes([]byte(sym)); err != rmarsh.ErrInvalidSymbol {
+			t.Errorf("SymbolBytes(%q): unexpected error %+v", sym, err)
+		}
+		if err := gen.StartObject(sym, 0); err != rmarsh.ErrInvalidSymbol {
+			t.Errorf("StartObject(%q): unexpected error %+v", sym, err)
+		}
+	}
+
+	for _, sym := range []string{"foo", "@bar", "Foo::Bar", "a b", "caf\u00e9"} {
+		if !rmarsh.IsValidSymbol(sym) {
+			t.Errorf("IsValidSymbol(%q) = false", sym)
+		}
+	}
+}
+
+// Symbols with non-ASCII names are marked as UTF-8 the first time they're written, as Ruby does. Names that aren't valid
+// UTF-8 are written as binary Symbols.
+func TestGenSymbolUTF8(t *testing.T) {
+	raw := genStream(t, func(gen *rmarsh.Generator) error {
+		if err := gen.StartArray(3); err != nil {
+			return err
+		}
+		for _, sym := range []string{"caf\u00e9", "caf\u00e9", "\xFFbin"} {
+			if err := gen.Symbol(sym); err != nil {
+				return err
+			}
+		}
+		return gen.EndArray()
+	})
+
+	exp := []byte{0x04, 0x08, '[', 0x08, 'I', ':', 0x0a, 'c', 'a', 'f', 0xc3, 0xa9, 0x06, ':', 0x06, 'E', 'T', ';', 0x00, ':', 0x09, 0xff, 'b', 'i', 'n'}
+	if !bytes.Equal(raw, exp) {
+		t.Errorf("Generated %x, expected %x", raw, exp)
+	}
+}
+
 func BenchmarkGenSymbol(b *testing.B) {
 	gen := rmarsh.NewGenerator(ioutil.Discard)
 
@@ -270,6 +332,50 @@ func TestGenHash(t *testing.T) {
 	})
 }
 
+func TestGenHashUniqueKeys(t *testing.T) {
+	b := new(bytes.Buffer)
+	gen := rmarsh.NewGenerator(b)
+	gen.SetUniqueHashKeys(true)
+
+	if err := gen.StartHash(3); err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.Symbol("foo"); err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.Nil(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.String("foo"); err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.Nil(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Duplicate keys are rejected and discarded, so writing can continue with a different key.
+	if err := gen.Symbol("foo"); err != rmarsh.ErrDuplicateHashKey {
+		t.Fatalf("Unexpected error %+v", err)
+	}
+	if err := gen.String("foo"); err != rmarsh.ErrDuplicateHashKey {
+		t.Fatalf("Unexpected error %+v", err)
+	}
+	if err := gen.Symbol("bar"); err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.Nil(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.EndHash(); err != nil {
+		t.Fatal(err)
+	}
+
+	exp := []byte{0x04, 0x08, '{', 0x08, ':', 0x08, 'f', 'o', 'o', '0', '"', 0x08, 'f', 'o', 'o', '0', ':', 0x08, 'b', 'a', 'r', '0'}
+	if !bytes.Equal(b.Bytes(), exp) {
+		t.Fatalf("Generated %x, expected %x", b.Bytes(), exp)
+	}
+}
+
 func BenchmarkGenHash(b *testing.B) {
 	gen := rmarsh.NewGenerator(ioutil.Discard)
 
@@ -372,6 +478,202 @@ func BenchmarkGenIVar(b *testing.B) {
 	}
 }
 
+func genUTF8String(policy rmarsh.UTF8Policy, str string) ([]byte, error) {
+	b := new(bytes.Buffer)
+	gen := rmarsh.NewGenerator(b)
+	gen.SetUTF8Policy(policy)
+
+	if err := gen.StartIVar(1); err != nil {
+		return nil, err
+	}
+	if err := gen.String(str); err != nil {
+		return nil, err
+	}
+	if err := gen.Symbol("E"); err != nil {
+		return nil, err
+	}
+	if err := gen.Bool(true); err != nil {
+		return nil, err
+	}
+	if err := gen.EndIVar(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func TestGenUTF8Policy(t *testing.T) {
+	valid := []byte{0x04, 0x08, 'I', '"', 0x07, 0xC3, 0xA9, 0x06, ':', 0x06, 'E', 'T'}
+	invalid := []byte{0x04, 0x08, 'I', '"', 0x07, 'a', 0xFF, 0x06, ':', 0x06, 'E', 'T'}
+	tests := []struct {
+		policy rmarsh.UTF8Policy
+		str    string
+		exp    []byte
+		err    error
+	}{
+		{rmarsh.UTF8Fail, "\u00e9", valid, nil},
+		{rmarsh.UTF8Ignore, "a\xFF", invalid, nil},
+		{rmarsh.UTF8Fail, "a\xFF", nil, rmarsh.ErrInvalidUTF8},
+		{rmarsh.UTF8Replace, "a\xFF", []byte{0x04, 0x08, 'I', '"', 0x09, 'a', 0xEF, 0xBF, 0xBD, 0x06, ':', 0x06, 'E', 'T'}, nil},
+		{rmarsh.UTF8Binary, "a\xFF", []byte{0x04, 0x08, 'I', '"', 0x07, 'a', 0xFF, 0x06, ':', 0x0D, 'e', 'n', 'c', 'o', 'd', 'i', 'n', 'g',
+			'"', 0x0F, 'A', 'S', 'C', 'I', 'I', '-', '8', 'B', 'I', 'T'}, nil},
+	}
+
+	for _, test := range tests {
+		raw, err := genUTF8String(test.policy, test.str)
+		if err != test.err {
+			t.Errorf("Policy %d with %q: unexpected error %+v", test.policy, test.str, err)
+		} else if !bytes.Equal(raw, test.exp) {
+			t.Errorf("Policy %d with %q: generated %x, expected %x", test.policy, test.str, raw, test.exp)
+		}
+	}
+}
+
+func TestGenUTF8PolicyRuby(t *testing.T) {
+	raw, err := genUTF8String(rmarsh.UTF8Replace, "a\xFF")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if str := rbDecode(t, raw); str != "\"a\uFFFD\"" {
+		t.Errorf("Decoded %s", str)
+	}
+
+	raw, err = genUTF8String(rmarsh.UTF8Binary, "a\xFF")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if str := rbDecode(t, raw); str != `"a\xFF"` {
+		t.Errorf("Decoded %s", str)
+	}
+}
+
+func TestGenMaxOutputBytes(t *testing.T) {
+	b := new(bytes.Buffer)
+	gen := rmarsh.NewGenerator(b)
+	gen.SetMaxOutputBytes(8)
+
+	if err := gen.StartArray(2); err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.String("ok"); err != nil {
+		t.Fatal(err)
+	}
+	err := gen.String("too much")
+	// The header, the array, "ok" and "too much" take 2 + 2 + 4 + 10 bytes.
+	if lerr, ok := err.(rmarsh.LimitError); !ok || lerr.Max != 8 || lerr.Offset != 18 {
+		t.Fatalf("Unexpected error %+v", err)
+	}
+	if b.Len() > 0 {
+		t.Fatalf("Generator wrote %x", b.Bytes())
+	}
+
+	// Streams within the limit are unaffected.
+	gen.Reset(nil)
+	if err := gen.String("ok"); err != nil {
+		t.Fatal(err)
+	}
+	if b.Len() != 6 {
+		t.Fatalf("Generator wrote %x", b.Bytes())
+	}
+}
+
+func TestGenBytes(t *testing.T) {
+	var buf bytes.Buffer
+	gen := rmarsh.NewGenerator(&buf)
+	sym, str := []byte("foo"), []byte("bar")
+
+	write := func() {
+		buf.Reset()
+		gen.Reset(nil)
+		if err := gen.StartArray(3); err != nil {
+			t.Fatal(err)
+		}
+		for _, err := range []error{gen.SymbolBytes(sym), gen.SymbolBytes(sym), gen.StringBytes(str)} {
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := gen.EndArray(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write()
+	exp := []byte{0x04, 0x08, '[', 0x08, ':', 0x08, 'f', 'o', 'o', ';', 0x00, '"', 0x08, 'b', 'a', 'r'}
+	if !bytes.Equal(buf.Bytes(), exp) {
+		t.Errorf("Wrote %X, expected %X", buf.Bytes(), exp)
+	}
+
+	// Only the first occurrence of the symbol should need copying.
+	if allocs := testing.AllocsPerRun(100, write); allocs > 1 {
+		t.Errorf("%v allocations per run", allocs)
+	}
+}
+
+func TestGenException(t *testing.T) {
+	var buf bytes.Buffer
+	gen := rmarsh.NewGenerator(&buf)
+	if err := gen.Exception("RuntimeError", fmt.Errorf("boom")); err != nil {
+		t.Fatal(err)
+	}
+	exp := append([]byte{0x04, 0x08, 'o', ':', 0x11}, "RuntimeError"...)
+	exp = append(exp, 0x07, ':', 0x09, 'm', 'e', 's', 'g', 'I', '"', 0x09, 'b', 'o', 'o', 'm', 0x06, ':', 0x06, 'E', 'T')
+	exp = append(exp, ':', 0x07, 'b', 't', '0')
+	if !bytes.Equal(buf.Bytes(), exp) {
+		t.Errorf("Wrote %X, expected %X", buf.Bytes(), exp)
+	}
+
+	buf.Reset()
+	gen.Reset(nil)
+	if err := gen.Exception("RuntimeError", errors.Wrap(errors.WithStack(fmt.Errorf("boom")), "failed")); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(buf.Bytes(), []byte("failed: boom")) {
+		t.Errorf("Message missing from %q", buf.Bytes())
+	}
+	if !bytes.Contains(buf.Bytes(), []byte("in `github.com/samcday/rmarsh_test.TestGenException'")) {
+		t.Errorf("Backtrace missing from %q", buf.Bytes())
+	}
+
+	buf.Reset()
+	gen.Reset(nil)
+	if err := gen.Exception("RuntimeError", nil); err == nil {
+		t.Error("Expected error for nil error")
+	}
+	if buf.Len() > 0 {
+		t.Errorf("Wrote %X for nil error", buf.Bytes())
+	}
+}
+
+func TestGenSafeSubset(t *testing.T) {
+	unsafe := map[string]func(gen *rmarsh.Generator) error{
+		"class":   func(gen *rmarsh.Generator) error { return gen.Class("File") },
+		"module":  func(gen *rmarsh.Generator) error { return gen.Module("Kernel") },
+		"object":  func(gen *rmarsh.Generator) error { return gen.StartObject("Foo", 0) },
+		"struct":  func(gen *rmarsh.Generator) error { return gen.StartStruct("Foo", 0) },
+		"usrdef":  func(gen *rmarsh.Generator) error { return gen.UserDefinedObject("Foo", "") },
+		"usrmars": func(gen *rmarsh.Generator) error { return gen.StartUserMarshalled("Foo") },
+	}
+	for name, f := range unsafe {
+		gen := rmarsh.NewGenerator(ioutil.Discard)
+		gen.SetSafeSubset(true)
+		if err := f(gen); err != rmarsh.ErrUnsafeValue {
+			t.Errorf("%s: unexpected error %+v", name, err)
+		}
+	}
+
+	gen := rmarsh.NewGenerator(ioutil.Discard)
+	gen.SetSafeSubset(true)
+	if err := gen.StartArray(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.String("ok"); err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.EndArray(); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestGenIVarInvalidKey(t *testing.T) {
 	gen := rmarsh.NewGenerator(ioutil.Discard)
 	if err := gen.StartIVar(1); err != nil {
@@ -463,6 +765,38 @@ func BenchmarkGenUserDefined(b *testing.B) {
 	}
 }
 
+func TestGenTime(t *testing.T) {
+	zone := time.FixedZone("CET", 3600)
+	testGenerator(t, "2017-01-02 03:04:05.123456789 +0100", func(gen *rmarsh.Generator) error {
+		return gen.Time(time.Date(2017, 1, 2, 3, 4, 5, 123456789, zone))
+	})
+	testGenerator(t, "2017-01-02 03:04:05 UTC", func(gen *rmarsh.Generator) error {
+		return gen.Time(time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC))
+	})
+}
+
+func TestGenTimeLayout(t *testing.T) {
+	var buf bytes.Buffer
+	gen := rmarsh.NewGenerator(&buf)
+	if err := gen.Time(time.Date(2017, 1, 2, 3, 4, 5, 6, time.UTC)); err != nil {
+		t.Fatal(err)
+	}
+
+	exp := []byte{0x04, 0x08, 'I', 'u', ':', 0x09, 'T', 'i', 'm', 'e', 0x0d, 0x43, 0x40, 0x1d, 0xc0, 0x00, 0x00, 0x50, 0x10, 0x09}
+	exp = append(exp, ':', 0x0d, 'n', 'a', 'n', 'o', '_', 'n', 'u', 'm', 'i', 0x0b)
+	exp = append(exp, ':', 0x0d, 'n', 'a', 'n', 'o', '_', 'd', 'e', 'n', 'i', 0x06)
+	exp = append(exp, ':', 0x0d, 's', 'u', 'b', 'm', 'i', 'c', 'r', 'o', '"', 0x07, 0x00, 0x60)
+	exp = append(exp, ':', 0x09, 'z', 'o', 'n', 'e', 'I', '"', 0x08, 'U', 'T', 'C', 0x06, ':', 0x06, 'E', 'F')
+	if !bytes.Equal(buf.Bytes(), exp) {
+		t.Errorf("Wrote %X, expected %X", buf.Bytes(), exp)
+	}
+
+	gen.Reset(nil)
+	if err := gen.Time(time.Date(1800, 1, 1, 0, 0, 0, 0, time.UTC)); err == nil {
+		t.Error("Expected error for year out of range")
+	}
+}
+
 func TestGenRegexp(t *testing.T) {
 	testGenerator(t, `/test/i`, func(gen *rmarsh.Generator) error {
 		return gen.Regexp("test", rmarsh.RegexpIgnoreCase)
@@ -504,3 +838,56 @@ func BenchmarkGenStruct(b *testing.B) {
 		}
 	}
 }
+
+// Generating values should not allocate once the Generator has warmed up.
+func TestGenAllocs(t *testing.T) {
+	syms := make([]string, 100)
+	for i := range syms {
+		syms[i] = fmt.Sprintf("sym%d", i)
+	}
+
+	tests := map[string]func(gen *rmarsh.Generator) error{
+		"fixnum": func(gen *rmarsh.Generator) error { return gen.Fixnum(0xDEAD) },
+		"float":  func(gen *rmarsh.Generator) error { return gen.Float(123.321) },
+		"symbol": func(gen *rmarsh.Generator) error { return gen.Symbol("test") },
+		"string": func(gen *rmarsh.Generator) error { return gen.String("test") },
+		"array": func(gen *rmarsh.Generator) error {
+			if err := gen.StartArray(1000); err != nil {
+				return err
+			}
+			for i := 0; i < 1000; i++ {
+				if err := gen.Fixnum(int64(i)); err != nil {
+					return err
+				}
+			}
+			return gen.EndArray()
+		},
+		"hash": func(gen *rmarsh.Generator) error {
+			if err := gen.StartHash(len(syms)); err != nil {
+				return err
+			}
+			for _, sym := range syms {
+				if err := gen.Symbol(sym); err != nil {
+					return err
+				}
+				if err := gen.String(sym); err != nil {
+					return err
+				}
+			}
+			return gen.EndHash()
+		},
+	}
+
+	for name, f := range tests {
+		gen := rmarsh.NewGenerator(ioutil.Discard)
+		allocs := testing.AllocsPerRun(100, func() {
+			gen.Reset(nil)
+			if err := f(gen); err != nil {
+				t.Fatal(err)
+			}
+		})
+		if allocs > 0 {
+			t.Errorf("%s: %v allocations per run", name, allocs)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package rmarsh
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// A Graph describes the linkable objects in a Marshal stream and how they refer to each other. It's intended to help
+// explain where the bulk of a large stream comes from. A Graph serializes to JSON via encoding/json, or can be rendered
+// for Graphviz with WriteDOT.
+type Graph struct {
+	Nodes []GraphNode `json:"nodes"` // Every linkable object in the stream, indexed by link id.
+	Edges []GraphEdge `json:"edges"`
+}
+
+// A GraphNode is a single linkable object in a Marshal stream.
+type GraphNode struct {
+	ID     int    `json:"id"`              // Link id of the object.
+	Type   string `json:"type"`            // Marshal type of the object, e.g "Array" or "Object".
+	Class  string `json:"class,omitempty"` // Class name, for objects, structs, user defined types and user subclasses.
+	Offset int    `json:"offset"`
+	Size   int    `json:"size"` // Number of bytes the object occupies, including everything nested within it.
+}
+
+// A GraphEdge is a reference from one object to another. The referenced object is either nested directly within the
+// referring one, or, if Link is set, referred to with an object link.
+type GraphEdge struct {
+	From int  `json:"from"`
+	To   int  `json:"to"`
+	Link bool `json:"link,omitempty"`
+}
+
+// NewGraph reads a complete Marshal stream from r and builds a Graph of the objects within it. Reads from r are
+// buffered, so bytes past the end of the Marshal stream may be consumed.
+func NewGraph(r io.Reader) (*Graph, error) {
+	var links []extractEvent
+	s := scanner{r: bufio.NewReader(r), record: true}
+	s.onRef = func(typ byte, id, beg, end int) error {
+		if typ == typeLink {
+			links = append(links, extractEvent{off: beg, id: id})
+		}
+		return nil
+	}
+	if err := s.stream(); err != nil && err != errScanStop {
+		return nil, err
+	}
+	if !s.report.Valid() {
+		return nil, errors.Errorf("invalid Marshal stream: %s", s.report.Findings[0])
+	}
+
+	g := &Graph{Nodes: make([]GraphNode, len(s.objs))}
+	for id, obj := range s.objs {
+		g.Nodes[id] = GraphNode{ID: id, Type: typeName(obj.typ), Class: obj.class, Offset: obj.Offset, Size: obj.Len}
+	}
+
+	// Objects are numbered in the order Ruby registers them, which isn't quite the order they appear in the stream. So
+	// to work out which object encloses another, we walk them by offset (outermost first) along with the links.
+	order := make([]int, len(s.objs))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		a, b := s.objs[order[i]], s.objs[order[j]]
+		return a.Offset < b.Offset || a.Offset == b.Offset && a.Len > b.Len
+	})
+
+	var stack []int
+	enclosing := func(off int) int {
+		for len(stack) > 0 {
+			top := s.objs[stack[len(stack)-1]]
+			if off < top.Offset+top.Len {
+				return stack[len(stack)-1]
+			}
+			stack = stack[:len(stack)-1]
+		}
+		return -1
+	}
+	for _, id := range order {
+		for len(links) > 0 && links[0].off < s.objs[id].Offset {
+			if from := enclosing(links[0].off); from >= 0 {
+				g.Edges = append(g.Edges, GraphEdge{From: from, To: links[0].id, Link: true})
+			}
+			links = links[1:]
+		}
+		if from := enclosing(s.objs[id].Offset); from >= 0 {
+			g.Edges = append(g.Edges, GraphEdge{From: from, To: id})
+		}
+		stack = append(stack, id)
+	}
+	for _, lnk := range links {
+		if from := enclosing(lnk.off); from >= 0 {
+			g.Edges = append(g.Edges, GraphEdge{From: from, To: lnk.id, Link: true})
+		}
+	}
+
+	return g, nil
+}
+
+// WriteDOT renders the Graph in the Graphviz DOT language. Nested objects are drawn with solid edges, and object links
+// with dashed edges.
+func (g *Graph) WriteDOT(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	bw.WriteString("digraph marshal {\n")
+	for _, n := range g.Nodes {
+		label := n.Type
+		if n.Class != "" {
+			label = n.Class
+		}
+		fmt.Fprintf(bw, "\tn%d [label=%s];\n", n.ID, strconv.Quote(fmt.Sprintf("%s\n%d bytes", label, n.Size)))
+	}
+	for _, e := range g.Edges {
+		if e.Link {
+			fmt.Fprintf(bw, "\tn%d -> n%d [style=dashed];\n", e.From, e.To)
+		} else {
+			fmt.Fprintf(bw, "\tn%d -> n%d;\n", e.From, e.To)
+		}
+	}
+	bw.WriteString("}\n")
+	return errors.Wrap(bw.Flush(), "write DOT")
+}
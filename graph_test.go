@@ -0,0 +1,77 @@
+package rmarsh_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/samcday/rmarsh"
+)
+
+// [#<Foo @a="x">, @2, Bar[], Baz._load("d") with ivar E=true]
+var graphStream = []byte{
+	0x04, 0x08, '[', 0x09,
+	'o', ':', 0x08, 'F', 'o', 'o', 0x06, ':', 0x07, '@', 'a', '"', 0x06, 'x',
+	'@', 0x07,
+	'C', ':', 0x08, 'B', 'a', 'r', '[', 0x00,
+	'I', 'u', ':', 0x08, 'B', 'a', 'z', 0x06, 'd', 0x06, ':', 0x06, 'E', 'T',
+}
+
+func TestGraph(t *testing.T) {
+	g, err := rmarsh.NewGraph(bytes.NewReader(graphStream))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expNodes := []rmarsh.GraphNode{
+		{ID: 0, Type: "Array", Offset: 2, Size: len(graphStream) - 2},
+		{ID: 1, Type: "Object", Class: "Foo", Offset: 4, Size: 14},
+		{ID: 2, Type: "String", Offset: 15, Size: 3},
+		{ID: 3, Type: "Array", Class: "Bar", Offset: 20, Size: 8},
+		{ID: 4, Type: "UserDefined", Class: "Baz", Offset: 28, Size: 14},
+	}
+	if !reflect.DeepEqual(g.Nodes, expNodes) {
+		t.Errorf("Graph nodes %+v, expected %+v", g.Nodes, expNodes)
+	}
+
+	expEdges := []rmarsh.GraphEdge{
+		{From: 0, To: 1},
+		{From: 1, To: 2},
+		{From: 0, To: 2, Link: true},
+		{From: 0, To: 3},
+		{From: 0, To: 4},
+	}
+	if !reflect.DeepEqual(g.Edges, expEdges) {
+		t.Errorf("Graph edges %+v, expected %+v", g.Edges, expEdges)
+	}
+
+	if _, err := json.Marshal(g); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGraphDOT(t *testing.T) {
+	g, err := rmarsh.NewGraph(bytes.NewReader(graphStream))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var b bytes.Buffer
+	if err := g.WriteDOT(&b); err != nil {
+		t.Fatal(err)
+	}
+	dot := b.String()
+	for _, exp := range []string{"digraph marshal {\n", "\tn1 [label=\"Foo\\n14 bytes\"];\n", "\tn0 -> n2 [style=dashed];\n", "\tn0 -> n3;\n"} {
+		if !strings.Contains(dot, exp) {
+			t.Errorf("DOT output %q does not contain %q", dot, exp)
+		}
+	}
+}
+
+func TestGraphInvalid(t *testing.T) {
+	if _, err := rmarsh.NewGraph(bytes.NewReader(graphStream[:10])); err == nil {
+		t.Fatal("Expected error for truncated stream")
+	}
+}
@@ -0,0 +1,194 @@
+package rmarsh
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// A Span locates a complete value within a Marshal stream.
+type Span struct {
+	Offset int // Offset of the first byte of the value, counted from the start of the stream (including magic header).
+	Len    int // Number of bytes the value occupies.
+}
+
+// An Index records the location of values within a large Marshal stream, so that individual nested values can be
+// extracted later by seeking straight to them, rather than parsing the whole stream again.
+// An Index isn't modified once it's built, so Extract may be called from multiple goroutines at once, as long as the
+// Paths map isn't modified at the same time.
+type Index struct {
+	// Paths maps the path of each value in the stream to its location. The top level value has the path "". Array
+	// elements are addressed by position (e.g "[3]"), hash values by their key (e.g "[:sym]", `["str"]` or "[123]"), and
+	// the instance variables of objects and the members of structs by name (e.g ".@foo"). Hash values with keys that are
+	// not Symbols, Strings or Fixnums are addressed by the position of the entry in the hash (e.g "[#2]").
+	// Paths are concatenated as values nest, e.g `[0][:user].@name`.
+	Paths map[string]Span
+
+	syms    []string    // symbol table of the stream
+	symOffs []int       // location of each symbol definition in the stream
+	objs    []scanObj   // location of each linkable object in the stream, by link id
+	objIDs  map[int]int // link id of each linkable object, by offset
+}
+
+// NewIndex reads a complete Marshal stream from r and builds an Index of it. Reads from r are buffered, so bytes past
+// the end of the Marshal stream may be consumed.
+func NewIndex(r io.Reader) (*Index, error) {
+	s := scanner{r: bufio.NewReader(r), record: true, paths: make(map[string]Span)}
+	if err := s.stream(); err != nil && err != errScanStop {
+		return nil, err
+	}
+	if !s.report.Valid() {
+		return nil, errors.Errorf("invalid Marshal stream: %s", s.report.Findings[0])
+	}
+
+	idx := &Index{
+		Paths:   s.paths,
+		syms:    s.syms,
+		symOffs: s.symOffs,
+		objs:    s.objs,
+		objIDs:  make(map[int]int, len(s.objs)),
+	}
+	for id, obj := range idx.objs {
+		idx.objIDs[obj.Offset] = id
+	}
+	return idx, nil
+}
+
+// Extract reads the value at the given path from r, which must contain the same Marshal stream the Index was built
+// from, and returns it as a standalone Marshal stream. Symlinks and object links within the value are renumbered. Any
+// that refer to symbols or objects outside of the value are resolved by copying in the referenced data.
+func (idx *Index) Extract(r io.ReaderAt, path string) ([]byte, error) {
+	span, ok := idx.Paths[path]
+	if !ok {
+		return nil, errors.Errorf("path %q not found in index", path)
+	}
+
+	x := extractor{idx: idx, r: r, syms: make(map[int]int), objs: make(map[int]int)}
+	x.out.Write(magic)
+	if err := x.copy(span); err != nil {
+		return nil, err
+	}
+	return x.out.Bytes(), nil
+}
+
+// An extractor copies values out of a Marshal stream, rewriting symlinks and links as it goes.
+type extractor struct {
+	idx *Index
+	r   io.ReaderAt
+	out bytes.Buffer
+
+	syms  map[int]int // Symbol ids in the original stream, mapped to ids in the extracted stream.
+	objs  map[int]int // Link ids in the original stream, mapped to ids in the extracted stream.
+	nsyms int         // Number of symbols written to the extracted stream.
+	nobjs int         // Number of linkable objects written to the extracted stream.
+}
+
+// An extractEvent is something in the copied data that needs attention: a symbol definition, a linkable object being
+// assigned an id, or a symlink/link that needs rewriting.
+type extractEvent struct {
+	off int
+	end int
+	typ byte
+	id  int
+}
+
+func (x *extractor) copy(span Span) error {
+	buf := make([]byte, span.Len)
+	if n, err := x.r.ReadAt(buf, int64(span.Offset)); n < len(buf) {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return errors.Wrap(err, "extract")
+	}
+
+	// Scan the data we're copying to find all the interesting events. We don't care about findings for links and
+	// symlinks that point outside of the copied data, but anything else indicates the reader doesn't match the Index.
+	var refs []extractEvent
+	s := scanner{r: bufio.NewReader(bytes.NewReader(buf)), base: span.Offset, record: true}
+	s.onRef = func(typ byte, id, beg, end int) error {
+		refs = append(refs, extractEvent{beg, end, typ, id})
+		return nil
+	}
+	if err := s.value(); err == errScanStop {
+		return errors.Errorf("extract: %s", s.report.Findings[len(s.report.Findings)-1])
+	} else if err != nil {
+		return err
+	}
+
+	// Symbols and objects must be numbered before any reference at the same offset, so they go first.
+	var evts []extractEvent
+	for _, off := range s.symOffs {
+		evts = append(evts, extractEvent{off: off, typ: typeSymbol, id: sort.SearchInts(x.idx.symOffs, off)})
+	}
+	for _, obj := range s.objs {
+		id, ok := x.idx.objIDs[obj.Offset]
+		if !ok {
+			return errors.Errorf("extract: no object at offset %d in index", obj.Offset)
+		}
+		evts = append(evts, extractEvent{off: obj.reg, typ: typeObject, id: id})
+	}
+	evts = append(evts, refs...)
+	sort.SliceStable(evts, func(i, j int) bool { return evts[i].off < evts[j].off })
+
+	pos := span.Offset
+	for _, evt := range evts {
+		switch evt.typ {
+		case typeSymbol:
+			x.syms[evt.id] = x.nsyms
+			x.nsyms++
+			continue
+		case typeObject:
+			x.objs[evt.id] = x.nobjs
+			x.nobjs++
+			continue
+		}
+
+		x.out.Write(buf[pos-span.Offset : evt.off-span.Offset])
+		pos = evt.end
+
+		if evt.typ == typeSymlink {
+			if id, ok := x.syms[evt.id]; ok {
+				x.writeRef(typeSymlink, id)
+				continue
+			}
+			if evt.id >= len(x.idx.syms) {
+				return errors.Errorf("extract: symlink to unknown symbol %d", evt.id)
+			}
+			// Symbol was defined outside of the data we're copying, so we define it here instead.
+			sym := x.idx.syms[evt.id]
+			x.syms[evt.id] = x.nsyms
+			x.nsyms++
+			x.out.WriteByte(typeSymbol)
+			x.writeLong(len(sym))
+			x.out.WriteString(sym)
+			continue
+		}
+
+		if id, ok := x.objs[evt.id]; ok {
+			x.writeRef(typeLink, id)
+			continue
+		}
+		if evt.id >= len(x.idx.objs) {
+			return errors.Errorf("extract: link to unknown object %d", evt.id)
+		}
+		// Object lives outside of the data we're copying, so we copy it in here.
+		if err := x.copy(x.idx.objs[evt.id].Span); err != nil {
+			return err
+		}
+	}
+	x.out.Write(buf[pos-span.Offset:])
+	return nil
+}
+
+func (x *extractor) writeRef(typ byte, id int) {
+	x.out.WriteByte(typ)
+	x.writeLong(id)
+}
+
+func (x *extractor) writeLong(n int) {
+	var b [fixnumMaxBytes]byte
+	x.out.Write(b[:putLong(b[:], int64(n))])
+}
@@ -0,0 +1,146 @@
+package rmarsh_test
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+
+	"github.com/samcday/rmarsh"
+)
+
+// [{:a=>"x", :b=>[1, :a]}, "shared", @4, :a]
+var indexStream = []byte{
+	0x04, 0x08, '[', 0x09,
+	'{', 0x07,
+	':', 0x06, 'a', '"', 0x06, 'x',
+	':', 0x06, 'b', '[', 0x07, 'i', 0x06, ';', 0x00,
+	'"', 0x0B, 's', 'h', 'a', 'r', 'e', 'd',
+	'@', 0x09,
+	';', 0x00,
+}
+
+func TestIndexPaths(t *testing.T) {
+	idx, err := rmarsh.NewIndex(bytes.NewReader(indexStream))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp := map[string]rmarsh.Span{
+		"":           {2, len(indexStream) - 2},
+		"[0]":        {4, 17},
+		"[0][:a]":    {9, 3},
+		"[0][:b]":    {15, 6},
+		"[0][:b][0]": {17, 2},
+		"[0][:b][1]": {19, 2},
+		"[1]":        {21, 8},
+		"[2]":        {29, 2},
+		"[3]":        {31, 2},
+	}
+	if len(idx.Paths) != len(exp) {
+		t.Fatalf("Index has paths %v, expected %v", idx.Paths, exp)
+	}
+	for path, span := range exp {
+		if idx.Paths[path] != span {
+			t.Errorf("Path %q has span %v, expected %v", path, idx.Paths[path], span)
+		}
+	}
+}
+
+func TestIndexObjectPaths(t *testing.T) {
+	b := new(bytes.Buffer)
+	gen := rmarsh.NewGenerator(b)
+	gen.StartObject("Foo", 1)
+	gen.Symbol("@bar")
+	gen.StartHash(1)
+	gen.String("baz")
+	gen.Nil()
+	gen.EndHash()
+	if err := gen.EndObject(); err != nil {
+		t.Fatal(err)
+	}
+
+	idx, err := rmarsh.NewIndex(bytes.NewReader(b.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := idx.Paths[`.@bar["baz"]`]; !ok {
+		t.Fatalf("Path not found in %v", idx.Paths)
+	}
+}
+
+func TestIndexExtract(t *testing.T) {
+	idx, err := rmarsh.NewIndex(bytes.NewReader(indexStream))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path string
+		exp  []byte
+	}{
+		{"", indexStream},
+		// Symlink to a symbol defined outside the value is replaced with the symbol itself.
+		{"[0][:b]", []byte{0x04, 0x08, '[', 0x07, 'i', 0x06, ':', 0x06, 'a'}},
+		// Link to an object outside the value is replaced with the object.
+		{"[2]", []byte{0x04, 0x08, '"', 0x0B, 's', 'h', 'a', 'r', 'e', 'd'}},
+		{"[3]", []byte{0x04, 0x08, ':', 0x06, 'a'}},
+	}
+
+	for _, test := range tests {
+		b, err := idx.Extract(bytes.NewReader(indexStream), test.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, test.exp) {
+			t.Errorf("Extracted %q as %x, expected %x", test.path, b, test.exp)
+		}
+	}
+
+	if _, err := idx.Extract(bytes.NewReader(indexStream), "[4]"); err == nil {
+		t.Errorf("Expected error for unknown path")
+	}
+}
+
+// Extract doesn't modify the Index, so it can be shared between goroutines. Run with -race to check.
+func TestIndexExtractConcurrent(t *testing.T) {
+	idx, err := rmarsh.NewIndex(bytes.NewReader(indexStream))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := idx.Extract(bytes.NewReader(indexStream), "[2]"); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestIndexExtractRenumbersLinks(t *testing.T) {
+	// ["pad", ["s", @3]]
+	raw := []byte{0x04, 0x08, '[', 0x07, '"', 0x08, 'p', 'a', 'd', '[', 0x07, '"', 0x06, 's', '@', 0x08}
+	idx, err := rmarsh.NewIndex(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := idx.Extract(bytes.NewReader(raw), "[1]")
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := []byte{0x04, 0x08, '[', 0x07, '"', 0x06, 's', '@', 0x06}
+	if !bytes.Equal(b, exp) {
+		t.Fatalf("Extracted %x, expected %x", b, exp)
+	}
+}
+
+func TestIndexInvalid(t *testing.T) {
+	if _, err := rmarsh.NewIndex(bytes.NewReader(indexStream[:10])); err == nil {
+		t.Fatalf("Expected error")
+	}
+}
@@ -0,0 +1,70 @@
+package rmarsh
+
+// Marshal encodes integers (Fixnums, as well as the lengths of strings, arrays and the like, and link ids) as "longs".
+// Zero is a single 0 byte, and small magnitudes are a single byte offset by 5. Anything else is a byte holding the
+// number of bytes that follow (negated for negative numbers), then the value itself in little endian order. Everything
+// in this package that reads or writes a long goes through putLong and getLong.
+
+// putLong encodes n into the provided buffer, which must have room for at least fixnumMaxBytes.
+// Returns the number of bytes written.
+func putLong(b []byte, n int64) int {
+	if n == 0 {
+		b[0] = 0
+		return 1
+	} else if 0 < n && n < 0x7B {
+		b[0] = byte(n + 5)
+		return 1
+	} else if -0x7C < n && n < 0 {
+		b[0] = byte((n - 5) & 0xFF)
+		return 1
+	}
+
+	for i := 1; i < 5; i++ {
+		b[i] = byte(n & 0xFF)
+		n = n >> 8
+		if n == 0 {
+			b[0] = byte(i)
+			return i + 1
+		}
+		if n == -1 {
+			b[0] = byte(-i)
+			return i + 1
+		}
+	}
+	panic("Shouldn't *ever* reach here")
+}
+
+// getLong decodes a long from the start of b. It returns the value and the number of bytes the encoding occupies. If b
+// is too short to hold the complete encoding, n is 0 and sz is the number of bytes b needs to hold. This is the
+// inverse of putLong.
+func getLong(b []byte) (n int64, sz int) {
+	if len(b) == 0 {
+		return 0, 1
+	}
+
+	n = int64(int8(b[0]))
+	if n == 0 {
+		return 0, 1
+	} else if 4 < n && n < 128 {
+		return n - 5, 1
+	} else if -129 < n && n < -4 {
+		return n + 5, 1
+	}
+
+	sz = int(n)
+	n = 0
+	if sz < 0 {
+		sz = -sz
+		n = -1
+	}
+	if len(b) < 1+sz {
+		return 0, 1 + sz
+	}
+	for i := 0; i < sz; i++ {
+		if n < 0 {
+			n &= ^(0xff << uint(8*i))
+		}
+		n |= int64(b[1+i]) << uint(8*i)
+	}
+	return n, 1 + sz
+}
@@ -0,0 +1,86 @@
+package rmarsh
+
+import (
+	"bufio"
+	"bytes"
+	"math"
+	"math/rand"
+	"testing"
+	"testing/iotest"
+)
+
+// The number of random longs checked by TestLongRandom, on top of the boundaries of each encoding length.
+const longRandomCount = 100000
+
+// randomLongs returns a reproducible selection of longs spread across the full int32 range. Random values are mostly
+// 4 bytes long when encoded, so each value is also shifted right by a random amount to cover the shorter forms.
+func randomLongs() []int64 {
+	ns := []int64{
+		0, 1, -1, 122, -123, 123, -124,
+		0xFF, -0x100, 0x100, -0x101,
+		0xFFFF, -0x10000, 0x10000, -0x10001,
+		0xFFFFFF, -0x1000000, 0x1000000, -0x1000001,
+		math.MaxInt32, math.MinInt32,
+	}
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < longRandomCount; i++ {
+		ns = append(ns, int64(int32(rng.Uint32())>>uint(rng.Intn(32))))
+	}
+	return ns
+}
+
+// Everything that decodes a long should agree with putLong, whatever the value. This doesn't need Ruby, so it can
+// afford to check far more values than TestLongRuby.
+func TestLongRandom(t *testing.T) {
+	ns := randomLongs()
+
+	var b [fixnumMaxBytes]byte
+	for _, n := range ns {
+		sz := putLong(b[:], n)
+		if got, gotSz := getLong(b[:sz]); got != n || gotSz != sz {
+			t.Fatalf("getLong(%x) = %d, %d, expected %d, %d", b[:sz], got, gotSz, n, sz)
+		}
+		// A long that's been cut short reports how many bytes it needs, once it has the first byte to go on.
+		for i := 1; i < sz; i++ {
+			if got, gotSz := getLong(b[:i]); got != 0 || gotSz != sz {
+				t.Fatalf("getLong(%x) = %d, %d, expected 0, %d", b[:i], got, gotSz, sz)
+			}
+		}
+
+		p := NewParser(nil)
+		p.buf, p.buflen = b[:sz], sz
+		if got, gotSz, need := p.decodeLong(0); int64(got) != n || gotSz != sz || need != 0 {
+			t.Fatalf("decodeLong(%x) = %d, %d, %d, expected %d, %d, 0", b[:sz], got, gotSz, need, n, sz)
+		}
+		if sz > 1 {
+			p.buflen = 1
+			if _, _, need := p.decodeLong(0); need != sz-1 {
+				t.Fatalf("decodeLong(%x) needs %d more bytes, expected %d", b[:1], need, sz-1)
+			}
+		}
+
+		s := scanner{r: bufio.NewReader(bytes.NewReader(b[:sz]))}
+		if got, err := s.long(); err != nil || int64(got) != n || s.off() != sz {
+			t.Fatalf("scanner.long(%x) = %d, %v after %d bytes, expected %d after %d bytes", b[:sz], got, err, s.off(), n, sz)
+		}
+	}
+
+	// The Parser decodes Fixnums in readNum, which has to cope with a long being split across reads.
+	raw := append([]byte{0x04, 0x08, typeArray}, b[:putLong(b[:], int64(len(ns)))]...)
+	for _, n := range ns {
+		raw = append(raw, typeFixnum)
+		raw = append(raw, b[:putLong(b[:], n)]...)
+	}
+	p := NewParser(iotest.OneByteReader(bytes.NewReader(raw)))
+	if tok, _, _, err := p.Read(); err != nil || tok != TokenStartArray {
+		t.Fatalf("Read() = %s, %v, expected TokenStartArray", tok, err)
+	}
+	for _, n := range ns {
+		if tok, _, num, err := p.Read(); err != nil || tok != TokenFixnum || int64(num) != n || p.Int64() != n {
+			t.Fatalf("Read() = %s %d (Int64 %d), %v, expected TokenFixnum %d", tok, num, p.Int64(), err, n)
+		}
+	}
+	if tok, _, _, err := p.Read(); err != nil || tok != TokenEndArray {
+		t.Fatalf("Read() = %s, %v, expected TokenEndArray", tok, err)
+	}
+}
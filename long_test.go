@@ -0,0 +1,118 @@
+package rmarsh_test
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/samcday/rmarsh"
+)
+
+// Every interesting boundary of the Marshal long encoding: the single byte forms, and the transitions between each
+// multi-byte length, for both positive and negative numbers.
+var longBoundaries = []int64{
+	0, 1, -1, 4, -4, 5, -5, 122, -122, 123, -123, 124, -124,
+	0xFF, -0xFF, 0x100, -0x100, -0x101,
+	0xFFFF, -0xFFFF, 0x10000, -0x10000, -0x10001,
+	0xFFFFFF, -0xFFFFFF, 0x1000000, -0x1000000, -0x1000001,
+	0x3FFFFFFF, -0x40000000,
+}
+
+func genLong(t *testing.T, n int64) []byte {
+	b := new(bytes.Buffer)
+	if err := rmarsh.NewGenerator(b).Fixnum(n); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+// genSentinel generates [<value>, true]. The Parser doesn't check for trailing bytes, so a value is followed by a
+// sentinel to make sure it was read up to the correct position.
+func genSentinel(t *testing.T, value func(gen *rmarsh.Generator) error) []byte {
+	return genStream(t, func(gen *rmarsh.Generator) error {
+		if err := gen.StartArray(2); err != nil {
+			return err
+		}
+		if err := value(gen); err != nil {
+			return err
+		}
+		if err := gen.Bool(true); err != nil {
+			return err
+		}
+		return gen.EndArray()
+	})
+}
+
+func expectSentinel(t *testing.T, p *rmarsh.Parser) {
+	expectToken(t, p, rmarsh.TokenTrue)
+	expectToken(t, p, rmarsh.TokenEndArray)
+	expectToken(t, p, rmarsh.TokenEOF)
+}
+
+// The Generator encodes longs, and the Parser and Index decode them. Make sure they agree with each other at each
+// boundary, end to end. TestLongRandom covers the rest of the int32 range.
+func TestLongRoundTrip(t *testing.T) {
+	for _, n := range longBoundaries {
+		raw := genSentinel(t, func(gen *rmarsh.Generator) error { return gen.Fixnum(n) })
+		p := rmarsh.NewParser(bytes.NewReader(raw))
+		expectToken(t, p, rmarsh.TokenStartArray)
+		if _, num := expectToken(t, p, rmarsh.TokenFixnum); int64(num) != n || p.Int64() != n {
+			t.Errorf("Parsed %d (Int64 %d) from %x, expected %d", num, p.Int64(), raw, n)
+		}
+		expectSentinel(t, p)
+	}
+
+	b := new(bytes.Buffer)
+	gen := rmarsh.NewGenerator(b)
+	if err := gen.StartHash(len(longBoundaries)); err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range longBoundaries {
+		if err := gen.Fixnum(n); err != nil {
+			t.Fatal(err)
+		}
+		if err := gen.Nil(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := gen.EndHash(); err != nil {
+		t.Fatal(err)
+	}
+	idx, err := rmarsh.NewIndex(bytes.NewReader(b.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range longBoundaries {
+		if _, ok := idx.Paths["["+strconv.FormatInt(n, 10)+"]"]; !ok {
+			t.Errorf("Index is missing key %d", n)
+		}
+	}
+}
+
+// Longs are also used to encode lengths, which the Parser decodes on a separate path to Fixnum values.
+func TestLongLengths(t *testing.T) {
+	for _, n := range longBoundaries {
+		if n <= 0 || n > 0x10000 {
+			continue
+		}
+		sym := strings.Repeat("a", int(n))
+		raw := genSentinel(t, func(gen *rmarsh.Generator) error { return gen.Symbol(sym) })
+
+		p := rmarsh.NewParser(bytes.NewReader(raw))
+		expectToken(t, p, rmarsh.TokenStartArray)
+		if data, _ := expectToken(t, p, rmarsh.TokenSymbol); string(data) != sym {
+			t.Errorf("Parsed symbol of length %d, expected %d", len(data), n)
+		}
+		expectSentinel(t, p)
+	}
+}
+
+func TestLongRuby(t *testing.T) {
+	for _, n := range longBoundaries {
+		exp := rbEncode(t, strconv.FormatInt(n, 10))
+		if raw := genLong(t, n); !bytes.Equal(raw, exp) {
+			t.Errorf("Generated %x for %d, Ruby generated %x", raw, n, exp)
+		}
+	}
+}
@@ -1,8 +1,10 @@
 package rmarsh
 
 import (
+	"bytes"
 	"fmt"
 	"io"
+	"strings"
 
 	"github.com/pkg/errors"
 )
@@ -62,9 +64,24 @@ func (t Token) String() string {
 	return "UNKNOWN"
 }
 
+// ErrFixnumOverflow is returned by Parser.Read alongside a TokenFixnum whose value does not fit in an int. This can
+// only happen on 32-bit platforms. The Parser remains usable, the value can be retrieved with Int64.
+var ErrFixnumOverflow = fmt.Errorf("Fixnum overflows int, use Int64()")
+
+// The classes of error a Parser can encounter. Errors returned by a Parser can be tested against these with errors.Is.
+var (
+	ErrTruncated     = io.ErrUnexpectedEOF // The stream ended before the current value was complete.
+	ErrBadMagic      = fmt.Errorf("Bad magic header")
+	ErrUnknownType   = fmt.Errorf("Unknown type")
+	ErrBadLength     = fmt.Errorf("Invalid length")
+	ErrBadLink       = fmt.Errorf("Invalid link")
+	ErrLimitExceeded = fmt.Errorf("Limit exceeded")
+)
+
 // A ParserError is a description of an error encountered while parsing a Ruby Marshal stream.
 type ParserError struct {
 	msg    string
+	kind   error
 	Offset int
 }
 
@@ -72,6 +89,27 @@ func (e ParserError) Error() string {
 	return e.msg
 }
 
+// Unwrap returns the class of the error, e.g ErrBadLink.
+func (e ParserError) Unwrap() error {
+	return e.kind
+}
+
+// A LimitError is returned when a Marshal stream exceeds one of the limits configured on a Parser or Generator.
+type LimitError struct {
+	Limit  string // Name of the limit that was exceeded.
+	Max    int    // The configured value of the limit.
+	Offset int    // Offset in the stream at which the limit was exceeded.
+}
+
+func (e LimitError) Error() string {
+	return fmt.Sprintf("Marshal stream exceeds %s limit of %d", e.Limit, e.Max)
+}
+
+// Is reports whether target is ErrLimitExceeded, so all LimitErrors can be matched with errors.Is.
+func (e LimitError) Is(target error) bool {
+	return target == ErrLimitExceeded
+}
+
 // Parser is a low-level pull-based parser of the Ruby Marshal format.
 // A Parser will pull bytes from an underlying io.Reader as needed, but will never buffer past the
 // end of the current Marshal stream. Even though effort is made to be as efficient in pulling bytes
@@ -93,6 +131,38 @@ type Parser struct {
 	lnkTbl rngTbl // Store ranges marking the linkable objects we've parsed in the read buffer.
 	symTbl rngTbl // Store ranges marking the symbols we've parsed in the read buffer.
 
+	tee io.Writer // If set, receives a copy of every byte read from r.
+
+	symStr bool // If set, symbols are read as TokenString.
+
+	lnk int   // Link id of the most recently read token, see LinkID().
+	num int64 // Value of the most recently read Fixnum, see Int64().
+
+	maxSyms  int // Limit on the size of symTbl, or 0 for no limit.
+	maxLinks int // Limit on the size of lnkTbl, or 0 for no limit.
+
+	gen int // Incremented on every Reset, so stale ParserMarks can be detected.
+
+	stats statsTracker
+	trace io.Writer // If set, receives a line for every token read.
+	off   int       // Offset of the most recently read token.
+}
+
+// ErrStaleMark is returned by Parser.Restore when the ParserMark was taken before the Parser was last Reset, or by a
+// different Parser.
+var ErrStaleMark = fmt.Errorf("ParserMark does not belong to the current stream")
+
+// A ParserMark is a snapshot of a Parser's position in a Marshal stream, taken with Save.
+type ParserMark struct {
+	p     *Parser
+	gen   int
+	pos   int
+	state parserState
+	stack parserStack
+	nlnk  int
+	nsym  int
+	lnk   int
+	num   int64
 }
 
 func NewParser(r io.Reader) *Parser {
@@ -101,6 +171,7 @@ func NewParser(r io.Reader) *Parser {
 		buf:    make([]byte, bufInitSz),
 		bufcap: bufInitSz,
 		state:  parserStateTopLevel,
+		lnk:    -1,
 	}
 }
 
@@ -110,6 +181,9 @@ func (p *Parser) Reset(r io.Reader) {
 	p.stack = p.stack[0:0]
 	// p.cur = tokenInvalid
 	p.state = parserStateTopLevel
+	p.lnk = -1
+	p.gen++
+	p.stats.reset()
 
 	// If this a replay Parser, our reset is a little less ... reset-y.
 	// if p.lnkID > -1 {
@@ -127,11 +201,186 @@ func (p *Parser) Reset(r io.Reader) {
 	p.lnkTbl = p.lnkTbl[0:0]
 }
 
+// Tee configures the Parser to copy every byte it reads from the underlying io.Reader to w, so the original payload can
+// be captured (e.g for audit logging) while it's being parsed. Since the Parser never reads past the end of the current
+// Marshal stream, once TokenEOF has been read w will have received exactly one complete stream. The Tee remains in place
+// across calls to Reset. Passing a nil io.Writer disables it.
+func (p *Parser) Tee(w io.Writer) {
+	p.tee = w
+}
+
+// SetSymbolsAsStrings configures the Parser to read symbols as TokenString rather than TokenSymbol, for consumers that
+// don't care about the distinction. Symlinks are still resolved, the symbol they refer to is returned as a TokenString
+// too. The setting remains in place across calls to Reset.
+func (p *Parser) SetSymbolsAsStrings(b bool) {
+	p.symStr = b
+}
+
+// TraceTo configures the Parser to write a line to w for each token it reads, giving the offset of the token in the
+// stream, the token itself indented by its nesting depth, and its value if it has one. Errors are traced too. This is
+// intended for investigating problematic streams, and costs an allocation or two per token. Errors writing to w are
+// ignored. Passing a nil io.Writer disables tracing.
+func (p *Parser) TraceTo(w io.Writer) {
+	p.trace = w
+}
+
+// SetStatsHook configures a hook that receives Stats for each Marshal stream the Parser reads. The hook is called when
+// TokenEOF is first read, or when Read fails. Passing nil removes the hook.
+func (p *Parser) SetStatsHook(h StatsHook) {
+	p.stats.hook = h
+}
+
+// SetMaxSymbolTable limits the number of distinct symbols a Marshal stream may define. Since every symbol is retained
+// until the Parser is Reset, a hostile stream could otherwise declare millions of them. Read returns a LimitError once the
+// limit is exceeded. A limit of 0 (the default) means no limit.
+func (p *Parser) SetMaxSymbolTable(n int) {
+	p.maxSyms = n
+}
+
+// SetMaxLinkTable limits the number of linkable objects a Marshal stream may contain, in the same way as
+// SetMaxSymbolTable.
+func (p *Parser) SetMaxLinkTable(n int) {
+	p.maxLinks = n
+}
+
+// Save returns a ParserMark recording the current position of the Parser. Passing it to Restore rewinds the Parser back
+// to that position, so that the same tokens can be read again. Every byte the Parser reads from a stream is retained in
+// its read buffer until Reset, so rewinding never needs to go back to the underlying io.Reader. This makes two pass
+// algorithms (e.g count the elements, allocate, then fill) cheap.
+func (p *Parser) Save() ParserMark {
+	m := ParserMark{
+		p:     p,
+		gen:   p.gen,
+		pos:   p.pos,
+		state: p.state,
+		nlnk:  len(p.lnkTbl),
+		nsym:  len(p.symTbl),
+		lnk:   p.lnk,
+		num:   p.num,
+	}
+	if len(p.stack) > 0 {
+		m.stack = append(parserStack(nil), p.stack...)
+	}
+	return m
+}
+
+// Restore rewinds the Parser to a position previously recorded with Save. Symbols and linkable objects read since the
+// mark was taken are forgotten. A mark remains valid until the Parser is Reset, and can be restored more than once.
+func (p *Parser) Restore(m ParserMark) error {
+	if m.p != p || m.gen != p.gen {
+		return ErrStaleMark
+	}
+	p.pos = m.pos
+	p.state = m.state
+	p.stack = append(p.stack[0:0], m.stack...)
+	p.lnkTbl = p.lnkTbl[0:m.nlnk]
+	p.symTbl = p.symTbl[0:m.nsym]
+	p.lnk = m.lnk
+	p.num = m.num
+	return nil
+}
+
+// DebugDump returns a hex dump of the bytes the Parser has read within window bytes either side of the given offset in
+// the stream, such as the Offset of a ParserError. Errors deliberately don't embed the content of the stream, so that a
+// large or sensitive payload doesn't end up in logs; DebugDump allows that context to be fetched on demand instead.
+// Each line of the dump begins with the offset of its first byte. Only data still held in the read buffer (i.e since
+// the last Reset) is available.
+func (p *Parser) DebugDump(offset, window int) string {
+	beg, end := offset-window, offset+window
+	if beg < 0 {
+		beg = 0
+	}
+	if end > p.buflen {
+		end = p.buflen
+	}
+
+	var buf bytes.Buffer
+	for i := beg; i < end; i += 16 {
+		n := i + 16
+		if n > end {
+			n = end
+		}
+		fmt.Fprintf(&buf, "%08x  % x\n", i, p.buf[i:n])
+	}
+	return buf.String()
+}
+
+// LinkID returns the link id associated with the token most recently returned by Read. For TokenLink, this is the id
+// of the object being linked to. For linkable values such as TokenFloat, it's the id that subsequent links to the value
+// will use. Returns -1 for anything else.
+func (p *Parser) LinkID() int {
+	return p.lnk
+}
+
+// Int64 returns the value of the most recently read TokenFixnum. Fixnums in a Marshal stream can hold up to 32 bits of
+// magnitude, which exceeds the range of int on 32-bit platforms. In that case Read returns ErrFixnumOverflow, and the
+// value must be retrieved with Int64 instead.
+func (p *Parser) Int64() int64 {
+	return p.num
+}
+
+// Read returns the next token in the Marshal stream. Depending on the token, b contains the raw bytes of the value
+// (TokenFloat, TokenSymbol, TokenString) and num contains the value of a TokenFixnum, the number of elements in a
+// TokenStartArray, the number of key/value pairs in a TokenStartHash, or the number of instance variables in a
+// TokenIVarProps. The contents of b are only valid until the next call to Read or Reset. Link ids are available via
+// LinkID.
+// A value with instance variables (such as a String with an encoding) is read as TokenStartIVar, the value itself,
+// TokenIVarProps, a symbol and a value for each instance variable, and then TokenEndIVar.
 func (p *Parser) Read() (tok Token, b []byte, num int, err error) {
+	if p.stats.hook == nil && p.trace == nil {
+		return p.read()
+	}
+
+	if p.stats.hook != nil {
+		p.stats.begin()
+	}
+	tok, b, num, err = p.read()
+	if p.trace != nil {
+		p.traceToken(tok, b, err)
+	}
+	if p.stats.hook == nil {
+		return
+	}
+	if err != nil && err != ErrFixnumOverflow {
+		p.stats.finish(p.pos, err)
+	} else if tok == TokenEOF {
+		p.stats.finish(p.pos, nil)
+	} else {
+		p.stats.tokens++
+	}
+	return
+}
+
+func (p *Parser) traceToken(tok Token, b []byte, err error) {
+	if err != nil && err != ErrFixnumOverflow {
+		fmt.Fprintf(p.trace, "%d\terror: %v\n", p.pos, err)
+		return
+	}
+
+	depth := len(p.stack)
+	if tok == TokenStartArray || tok == TokenStartHash || tok == TokenStartIVar {
+		// The stack has already been pushed for the elements.
+		depth--
+	}
+	fmt.Fprintf(p.trace, "%d\t%s%s", p.off, strings.Repeat("  ", depth), tok)
+	switch tok {
+	case TokenFixnum:
+		fmt.Fprintf(p.trace, " %d", p.num)
+	case TokenFloat, TokenSymbol, TokenString:
+		fmt.Fprintf(p.trace, " %q", b)
+	case TokenLink:
+		fmt.Fprintf(p.trace, " @%d", p.lnk)
+	}
+	io.WriteString(p.trace, "\n")
+}
+
+func (p *Parser) read() (tok Token, b []byte, num int, err error) {
 	// Quick early bailout check here. If parser state is "parserStateEOF" then we can just
 	// return an EOF token and exit.
 	if p.state == parserStateEOF {
 		tok = TokenEOF
+		p.lnk = -1
+		p.off = p.pos
 		return
 	}
 
@@ -147,6 +396,7 @@ func (p *Parser) Read() (tok Token, b []byte, num int, err error) {
 	numRead := false
 	pleaseReadNumAt := 0
 	numSz := 0
+	var lng int64
 
 pullbytes:
 	if needed > 0 {
@@ -167,65 +417,43 @@ pullbytes:
 
 		p.buflen += needed
 
+		start := from
 		var n int
 		for from < to && err == nil {
 			n, err = p.r.Read(p.buf[from:to])
 			from += n
 		}
-		if err == io.EOF {
-			err = io.ErrUnexpectedEOF
+		if from == to {
+			// An io.Reader is permitted to return io.EOF alongside the final bytes it yields.
+			err = nil
+		} else if err == io.EOF {
+			err = ErrTruncated
 			return
 		} else if err != nil {
 			err = errors.Wrap(err, "fill")
 			return
 		}
 
+		if p.tee != nil {
+			if _, err = p.tee.Write(p.buf[start:to]); err != nil {
+				err = errors.Wrap(err, "tee")
+				return
+			}
+		}
+
 		needed = 0
 	}
 
 readNum:
 	if pleaseReadNumAt > 0 {
-		numSz = 1
-
-		if pleaseReadNumAt == p.buflen {
-			// A pretty shitty situation to end up in, unless we happen to be reading a Marshal stream
-			// that only contains a single fixnum.
-			needed = 1
+		lng, numSz = getLong(p.buf[pleaseReadNumAt:p.buflen])
+		if pleaseReadNumAt+numSz > p.buflen {
+			// If the long is at the very end of the read buffer we're in a pretty shitty situation, unless we happen to
+			// be reading a Marshal stream that only contains a single fixnum.
+			needed = pleaseReadNumAt + numSz - p.buflen
 			goto pullbytes
 		}
-
-		num = int(int8(p.buf[pleaseReadNumAt]))
-
-		// Can finish early if the num is 0.
-		if num != 0 {
-			// Easy ones first: single byte longs.
-			if 4 < num && num < 128 {
-				num = num - 5
-			} else if -129 < num && num < -4 {
-				num = num + 5
-			} else {
-				if num > 0 {
-					numSz = num
-					num = 0
-				} else {
-					numSz = -num
-					num = -1
-				}
-
-				if pleaseReadNumAt+1+numSz > p.buflen {
-					needed = pleaseReadNumAt + numSz + 1 - p.buflen
-					goto pullbytes
-				}
-
-				for i := 0; i < numSz; i++ {
-					if num < 0 {
-						num &= ^(0xff << uint(8*i))
-					}
-
-					num |= int(p.buf[pleaseReadNumAt+1+i]) << uint(8*i)
-				}
-			}
-		}
+		num = int(lng)
 
 		numRead = true
 		pleaseReadNumAt = 0
@@ -245,7 +473,7 @@ readNum:
 				}
 
 				if p.buf[p.pos] != 0x04 || p.buf[p.pos+1] != 0x08 {
-					err = p.parserError("Expected magic header 0x0408, got 0x%.4X", int16(p.buf[p.pos])<<8|int16(p.buf[p.pos+1]))
+					err = p.parserError(ErrBadMagic, "Expected magic header 0x0408, got 0x%.4X", int16(p.buf[p.pos])<<8|int16(p.buf[p.pos+1]))
 					return
 				}
 				p.pos = 2
@@ -254,6 +482,103 @@ readNum:
 			// Our next state is EOF.
 			// Unless we read something interesting below which pushes something onto the stack.
 			p.state = parserStateEOF
+
+		// state when reading elements of an array
+		case parserStateArray:
+			cur := p.stack.cur()
+			cur.pos++
+			if cur.pos == cur.sz {
+				p.state = parserStateArrayEnd
+			}
+
+		// state when reading a key in a hash
+		case parserStateHashKey:
+			p.state = parserStateHashValue
+
+		// state when reading a value in a hash
+		case parserStateHashValue:
+			cur := p.stack.cur()
+			cur.pos++
+			if cur.pos == cur.sz {
+				p.state = parserStateHashEnd
+			} else {
+				p.state = parserStateHashKey
+			}
+
+		// state when reading the value wrapped by an ivar
+		case parserStateIVarInit:
+			p.state = parserStateIVarLen
+
+		// state when the wrapped value has been read, and the number of instance variables follows
+		case parserStateIVarLen:
+			if !numRead {
+				pleaseReadNumAt = p.pos
+				goto readNum
+			}
+
+			if int64(num) != lng || num < 0 {
+				err = p.parserError(ErrBadLength, "Invalid ivar length %d", lng)
+				return
+			}
+			tok = TokenIVarProps
+			p.stack.cur().sz = num
+			if num == 0 {
+				p.state = parserStateIVarEnd
+			} else {
+				p.state = parserStateIVarKey
+			}
+
+			p.lnk = -1
+			p.off = p.pos
+			p.pos += numSz
+			return
+
+		// state when reading the name of an instance variable
+		case parserStateIVarKey:
+			if p.pos == p.buflen {
+				needed = 1
+				goto pullbytes
+			}
+			// Names with non-ASCII characters are wrapped in an ivar of their own, carrying the encoding.
+			if typ := p.buf[p.pos]; typ != typeSymbol && typ != typeSymlink && typ != typeIvar {
+				err = p.parserError(ErrUnknownType, "Expected symbol for ivar name, got type %d", typ)
+				return
+			}
+			p.state = parserStateIVarValue
+
+		// state when reading the value of an instance variable
+		case parserStateIVarValue:
+			cur := p.stack.cur()
+			cur.pos++
+			if cur.pos == cur.sz {
+				p.state = parserStateIVarEnd
+			} else {
+				p.state = parserStateIVarKey
+			}
+
+		// state when we've finished parsing an ivar
+		case parserStateIVarEnd:
+			tok = TokenEndIVar
+			p.state = p.stack.pop()
+
+			p.lnk = -1
+			p.off = p.pos
+			return
+
+		// state when we've finished parsing an array or hash
+		case parserStateArrayEnd, parserStateHashEnd:
+			tok = TokenEndArray
+			if p.state == parserStateHashEnd {
+				tok = TokenEndHash
+			}
+
+			cur := p.stack.cur()
+			p.lnkTbl[cur.lnk].end = p.pos
+			p.state = p.stack.pop()
+
+			p.lnk = -1
+			p.off = p.pos
+			return
 		}
 
 		// Now that we've run the SM, we don't want to run it again if the stream reads
@@ -271,6 +596,7 @@ readNum:
 	}
 
 	typ := p.buf[p.pos]
+	p.off = p.pos
 	rd := 1
 	linkable := false
 
@@ -293,6 +619,26 @@ readNum:
 		}
 
 		rd += numSz
+		p.num = lng
+		if int64(num) != lng {
+			num = 0
+			err = ErrFixnumOverflow
+		}
+
+	case typeLink:
+		tok = TokenLink
+
+		if !numRead {
+			pleaseReadNumAt = p.pos + rd
+			goto readNum
+		}
+
+		rd += numSz
+		if int64(num) != lng || num < 0 || num >= len(p.lnkTbl) {
+			err = p.parserError(ErrBadLink, "Invalid link id %d, %d linkable objects seen", num, len(p.lnkTbl))
+			return
+		}
+		p.lnk, num = num, 0
 
 	case typeFloat:
 		// start := p.pos
@@ -307,6 +653,34 @@ readNum:
 			goto pullbytes
 		}
 		rd += sz
+		if blobsz < 0 {
+			err = p.parserError(ErrBadLength, "Invalid float length %d", blobsz)
+			return
+		}
+
+		if p.pos+rd+blobsz > p.buflen {
+			needed = p.pos + rd + blobsz - p.buflen
+			goto pullbytes
+		}
+
+		b = p.buf[p.pos+rd : p.pos+rd+blobsz]
+		rd += blobsz
+		linkable = true
+
+	case typeString:
+		// Strings are read as raw bytes. Their encoding, if any, is given by the ivar that wraps them.
+		tok = TokenString
+
+		var blobsz, sz int
+		blobsz, sz, needed = p.decodeLong(p.pos + rd)
+		if needed > 0 {
+			goto pullbytes
+		}
+		rd += sz
+		if blobsz < 0 {
+			err = p.parserError(ErrBadLength, "Invalid string length %d", blobsz)
+			return
+		}
 
 		if p.pos+rd+blobsz > p.buflen {
 			needed = p.pos + rd + blobsz - p.buflen
@@ -329,6 +703,10 @@ readNum:
 			goto pullbytes
 		}
 		rd += sz
+		if blobsz < 0 {
+			err = p.parserError(ErrBadLength, "Invalid symbol length %d", blobsz)
+			return
+		}
 
 		if p.pos+rd+blobsz > p.buflen {
 			needed = p.pos + rd + blobsz - p.buflen
@@ -337,78 +715,135 @@ readNum:
 
 		b = p.buf[p.pos+rd : p.pos+rd+blobsz]
 		rd += blobsz
-		linkable = true
+
+		if p.maxSyms > 0 && len(p.symTbl) >= p.maxSyms {
+			err = LimitError{"symbol table", p.maxSyms, p.pos}
+			return
+		}
 
 		// We only insert into the symbol table if we're the top level parser.
 		// if p.lnkID == -1 {
-		if err = p.symTbl.add(rng{p.pos + rd, p.pos + rd + blobsz}); err != nil {
+		if err = p.symTbl.add(rng{p.pos + rd - blobsz, p.pos + rd}); err != nil {
 			return
 		}
 		// }
-	}
+		if p.symStr {
+			tok = TokenString
+		}
 
-	if linkable {
-		p.lnkTbl.add(rng{p.pos, p.pos + rd})
-	}
-	p.pos += rd
+	case typeSymlink:
+		tok = TokenSymbol
+		if p.symStr {
+			tok = TokenString
+		}
 
-	return
-}
+		if !numRead {
+			pleaseReadNumAt = p.pos + rd
+			goto readNum
+		}
 
-// decodeLong looks at a long in the read buffer at given pos and decodes it.
-// It will return either the decoded num, or the number of extra bytes it needs available
-// in the read buffer to complete decoding.
-func (p *Parser) decodeLong(pos int) (n, sz, need int) {
-	sz = 1
+		rd += numSz
+		if int64(num) != lng || num < 0 || num >= len(p.symTbl) {
+			err = p.parserError(ErrBadLink, "Invalid symlink id %d, %d symbols seen", num, len(p.symTbl))
+			return
+		}
+		sym := p.symTbl[num]
+		b, num = p.buf[sym.beg:sym.end], 0
 
-	if pos == p.buflen {
-		// A pretty shitty situation to end up in, unless we happen to be reading a Marshal stream
-		// that only contains a single fixnum.
-		need = 1
-		return
-	}
+	case typeArray:
+		tok = TokenStartArray
 
-	// Can finish early if the num is 0.
-	if p.buf[pos] == 0 {
-		return
-	}
+		if !numRead {
+			pleaseReadNumAt = p.pos + rd
+			goto readNum
+		}
 
-	n = int(int8(p.buf[pos]))
+		rd += numSz
+		if int64(num) != lng || num < 0 {
+			err = p.parserError(ErrBadLength, "Invalid array length %d", lng)
+			return
+		}
+		linkable = true
 
-	// Easy ones first: single byte longs.
-	if 4 < n && n < 128 {
-		n = n - 5
-		return
-	} else if -129 < n && n < -4 {
-		n = n + 5
-		return
-	} else if n > 0 {
-		sz = n
-		n = 0
-	} else {
-		sz = -n
-		n = -1
-	}
+	case typeHash:
+		tok = TokenStartHash
 
-	if pos+1+sz > p.buflen {
-		need = pos + sz + 1 - p.buflen
+		if !numRead {
+			pleaseReadNumAt = p.pos + rd
+			goto readNum
+		}
+
+		rd += numSz
+		if int64(num) != lng || num < 0 {
+			err = p.parserError(ErrBadLength, "Invalid hash length %d", lng)
+			return
+		}
+		linkable = true
+
+	case typeIvar:
+		// The wrapped value is linkable (or not) in its own right, the ivar itself is not.
+		tok = TokenStartIVar
+
+	default:
+		err = p.parserError(ErrUnknownType, "Unhandled type %d encountered", typ)
 		return
 	}
 
-	for i := 0; i < sz; i++ {
-		if n < 0 {
-			n &= ^(0xff << uint(8*i))
+	if linkable {
+		if p.maxLinks > 0 && len(p.lnkTbl) >= p.maxLinks {
+			err = LimitError{"link table", p.maxLinks, p.pos}
+			return
 		}
+		p.lnkTbl.add(rng{p.pos, p.pos + rd})
+		p.lnk = len(p.lnkTbl) - 1
+	} else if tok != TokenLink {
+		p.lnk = -1
+	}
+	p.pos += rd
 
-		n |= int(p.buf[pos+1+i]) << uint(8*i)
+	// Our state is woven through potentially many nested levels of context.
+	// If we start a new context for an array/hash we point its terminal state at our next one. For example if the top
+	// level value was a single depth array, once the array had finished parsing it would know to transition to
+	// parserStateEOF.
+	switch tok {
+	case TokenStartArray:
+		ctx := p.stack.push(ctxTypeArray, num, p.state)
+		ctx.lnk = p.lnk
+		if num == 0 {
+			p.state = parserStateArrayEnd
+		} else {
+			p.state = parserStateArray
+		}
+	case TokenStartHash:
+		ctx := p.stack.push(ctxTypeHash, num, p.state)
+		ctx.lnk = p.lnk
+		if num == 0 {
+			p.state = parserStateHashEnd
+		} else {
+			p.state = parserStateHashKey
+		}
+	case TokenStartIVar:
+		p.stack.push(ctxTypeIVar, 0, p.state)
+		p.state = parserStateIVarInit
 	}
 
 	return
 }
 
+// decodeLong looks at a long in the read buffer at given pos and decodes it.
+// It will return either the decoded num and the number of bytes it occupies, or the number of extra bytes it needs available
+// in the read buffer to complete decoding.
+func (p *Parser) decodeLong(pos int) (n, sz, need int) {
+	lng, sz := getLong(p.buf[pos:p.buflen])
+	if pos+sz > p.buflen {
+		return 0, 0, pos + sz - p.buflen
+	}
+	return int(lng), sz, 0
+}
+
 // Constructs a ParserError using the current pos of the Parser.
-func (p *Parser) parserError(format string, a ...interface{}) ParserError {
-	return ParserError{fmt.Sprintf(format, a...), p.pos}
+func (p *Parser) parserError(kind error, format string, a ...interface{}) ParserError {
+	return ParserError{fmt.Sprintf(format, a...), kind, p.pos}
 }
 
 const (
@@ -444,7 +879,7 @@ type parserCtx struct {
 	typ  uint8
 	sz   int
 	pos  int
-	r    *rng        // when this context is finished, r (pointing into lnkTbl) is updated with final location
+	lnk  int         // when this context is finished, this entry in lnkTbl is updated with final location
 	next parserState // Next state transition when we're done with this stack item
 }
 
@@ -482,7 +917,7 @@ func (stk *parserStack) push(typ uint8, sz int, next parserState) *parserCtx {
 		*stk = newStk[0:l]
 	}
 
-	*stk = append(*stk, parserCtx{typ: typ, sz: sz, r: nil, next: next})
+	*stk = append(*stk, parserCtx{typ: typ, sz: sz, next: next})
 	return &(*stk)[l]
 }
 
@@ -3,9 +3,13 @@ package rmarsh_test
 import (
 	"bytes"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"strconv"
 	"testing"
+	"testing/iotest"
 
 	"github.com/samcday/rmarsh"
 )
@@ -19,14 +23,14 @@ func parseFromRuby(t *testing.T, expr string) *rmarsh.Parser {
 }
 
 func expectToken(t testing.TB, p *rmarsh.Parser, exp rmarsh.Token) ([]byte, int) {
-	tok, buf, lnkID, err := p.Read()
+	tok, buf, num, err := p.Read()
 	if err != nil {
 		t.Fatal(err)
 	} else if tok != exp {
-		t.Fatalf("Token %q is not expected %q: %+v\nRaw:\n%s\n", tok, exp, hex.Dump(curRaw))
+		t.Fatalf("Token %q is not expected %q\nRaw:\n%s\n", tok, exp, hex.Dump(curRaw))
 	}
 
-	return buf, lnkID
+	return buf, num
 }
 
 func BenchmarkParserReset(b *testing.B) {
@@ -166,7 +170,22 @@ func TestParserFloat(t *testing.T) {
 	} else if n != 123.321 {
 		t.Errorf("p.Float() = %f, expected 123.321", n)
 	}
+	if id := p.LinkID(); id != 0 {
+		t.Errorf("p.LinkID() = %d, expected 0", id)
+	}
 	expectToken(t, p, rmarsh.TokenEOF)
+	if id := p.LinkID(); id != -1 {
+		t.Errorf("p.LinkID() = %d, expected -1", id)
+	}
+}
+
+func TestParserInvalidLink(t *testing.T) {
+	raw := []byte{0x04, 0x08, '@', 0x00}
+	p := rmarsh.NewParser(bytes.NewReader(raw))
+	_, _, _, err := p.Read()
+	if err == nil || err.Error() != "Invalid link id 0, 0 linkable objects seen" {
+		t.Fatalf("Unexpected err %s", err)
+	}
 }
 
 func BenchmarkParserFloatSingleByte(b *testing.B) {
@@ -206,6 +225,9 @@ func TestParserSymbol(t *testing.T) {
 	if str != "test" {
 		t.Errorf("p.Text() = %s, expected test", str)
 	}
+	if id := p.LinkID(); id != -1 {
+		t.Errorf("p.LinkID() = %d, expected -1", id)
+	}
 	expectToken(t, p, rmarsh.TokenEOF)
 }
 
@@ -244,3 +266,703 @@ func BenchmarkParserSymbolMultiByte(b *testing.B) {
 		}
 	}
 }
+
+func TestParserEmptyArray(t *testing.T) {
+	p := parseFromRuby(t, "[]")
+	if _, n := expectToken(t, p, rmarsh.TokenStartArray); n != 0 {
+		t.Errorf("Array length %d, expected 0", n)
+	}
+	expectToken(t, p, rmarsh.TokenEndArray)
+	expectToken(t, p, rmarsh.TokenEOF)
+}
+
+func BenchmarkParserEmptyArray(b *testing.B) {
+	buf := newCyclicReader(rbEncode(b, "[]"))
+	p := rmarsh.NewParser(buf)
+
+	for i := 0; i < b.N; i++ {
+		p.Reset(nil)
+
+		if tok, _, _, err := p.Read(); err != nil {
+			b.Fatal(err)
+		} else if tok != rmarsh.TokenStartArray {
+			b.Fatalf("Unexpected token %s", tok)
+		}
+		if tok, _, _, err := p.Read(); err != nil {
+			b.Fatal(err)
+		} else if tok != rmarsh.TokenEndArray {
+			b.Fatalf("Unexpected token %s", tok)
+		}
+	}
+}
+
+// Strings are read as raw bytes. Ruby wraps most of them in an ivar carrying their encoding, as it does Symbols with
+// non-ASCII names.
+func TestParserIVarString(t *testing.T) {
+	// ["foo", "".b, <link to "foo">, :café]
+	raw := []byte{
+		0x04, 0x08, '[', 0x09,
+		'I', '"', 0x08, 'f', 'o', 'o', 0x06, ':', 0x06, 'E', 'T',
+		'"', 0x00,
+		'@', 0x06,
+		'I', ':', 0x0A, 'c', 'a', 'f', 0xC3, 0xA9, 0x06, ';', 0x00, 'T',
+	}
+	exp := []struct {
+		tok rmarsh.Token
+		b   string
+		num int
+		lnk int
+	}{
+		{rmarsh.TokenStartArray, "", 4, 0},
+		{rmarsh.TokenStartIVar, "", 0, -1},
+		{rmarsh.TokenString, "foo", 0, 1},
+		{rmarsh.TokenIVarProps, "", 1, -1},
+		{rmarsh.TokenSymbol, "E", 0, -1},
+		{rmarsh.TokenTrue, "", 0, -1},
+		{rmarsh.TokenEndIVar, "", 0, -1},
+		{rmarsh.TokenString, "", 0, 2},
+		{rmarsh.TokenLink, "", 0, 1},
+		{rmarsh.TokenStartIVar, "", 0, -1},
+		{rmarsh.TokenSymbol, "caf\u00e9", 0, -1},
+		{rmarsh.TokenIVarProps, "", 1, -1},
+		{rmarsh.TokenSymbol, "E", 0, -1},
+		{rmarsh.TokenTrue, "", 0, -1},
+		{rmarsh.TokenEndIVar, "", 0, -1},
+		{rmarsh.TokenEndArray, "", 0, -1},
+		{rmarsh.TokenEOF, "", 0, -1},
+	}
+
+	// Reading a byte at a time makes sure the Parser copes with the stream arriving in pieces.
+	for _, r := range []io.Reader{bytes.NewReader(raw), iotest.OneByteReader(bytes.NewReader(raw))} {
+		p := rmarsh.NewParser(r)
+		for _, exp := range exp {
+			tok, b, num, err := p.Read()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tok != exp.tok || string(b) != exp.b || num != exp.num || p.LinkID() != exp.lnk {
+				t.Fatalf("Read %s %q %d (link %d), expected %s %q %d (link %d)", tok, b, num, p.LinkID(), exp.tok, exp.b, exp.num, exp.lnk)
+			}
+		}
+	}
+}
+
+func TestParserIVarInvalid(t *testing.T) {
+	tests := []struct {
+		raw []byte
+		exp error
+	}{
+		// Instance variable names must be symbols.
+		{[]byte{0x04, 0x08, 'I', '"', 0x00, 0x06, 'i', 0x06, 'T'}, rmarsh.ErrUnknownType},
+		{[]byte{0x04, 0x08, 'I', '"', 0x00, 0xFA}, rmarsh.ErrBadLength},
+		{[]byte{0x04, 0x08, 'I', '"', 0x00}, rmarsh.ErrTruncated},
+	}
+	for _, test := range tests {
+		p := rmarsh.NewParser(bytes.NewReader(test.raw))
+		var err error
+		for err == nil {
+			_, _, _, err = p.Read()
+		}
+		if !errors.Is(err, test.exp) {
+			t.Errorf("%X: error %v is not %v", test.raw, err, test.exp)
+		}
+	}
+}
+
+func TestParserNestedArray(t *testing.T) {
+	p := parseFromRuby(t, "[[]]")
+	expectToken(t, p, rmarsh.TokenStartArray)
+	expectToken(t, p, rmarsh.TokenStartArray)
+	expectToken(t, p, rmarsh.TokenEndArray)
+	expectToken(t, p, rmarsh.TokenEndArray)
+	expectToken(t, p, rmarsh.TokenEOF)
+
+	p = parseFromRuby(t, "[[], [1]]")
+	expectToken(t, p, rmarsh.TokenStartArray)
+	expectToken(t, p, rmarsh.TokenStartArray)
+	expectToken(t, p, rmarsh.TokenEndArray)
+	expectToken(t, p, rmarsh.TokenStartArray)
+	expectToken(t, p, rmarsh.TokenFixnum)
+	expectToken(t, p, rmarsh.TokenEndArray)
+	expectToken(t, p, rmarsh.TokenEndArray)
+	expectToken(t, p, rmarsh.TokenEOF)
+}
+
+func TestParserSymlink(t *testing.T) {
+	p := parseFromRuby(t, "[:test, :test]")
+	expectToken(t, p, rmarsh.TokenStartArray)
+	expectToken(t, p, rmarsh.TokenSymbol)
+	if b, _ := expectToken(t, p, rmarsh.TokenSymbol); string(b) != "test" {
+		t.Errorf("Symlink resolved to %q, expected test", b)
+	}
+	expectToken(t, p, rmarsh.TokenEndArray)
+	expectToken(t, p, rmarsh.TokenEOF)
+}
+
+func BenchmarkParserSymlink(b *testing.B) {
+	buf := newCyclicReader(rbEncode(b, "[:test, :test]"))
+	p := rmarsh.NewParser(buf)
+	exp := []byte("test")
+
+	for i := 0; i < b.N; i++ {
+		p.Reset(nil)
+
+		if tok, _, _, err := p.Read(); err != nil {
+			b.Fatal(err)
+		} else if tok != rmarsh.TokenStartArray {
+			b.Fatalf("Unexpected token %s", tok)
+		}
+		if tok, _, _, err := p.Read(); err != nil {
+			b.Fatal(err)
+		} else if tok != rmarsh.TokenSymbol {
+			b.Fatalf("Unexpected token %s", tok)
+		}
+		if tok, data, _, err := p.Read(); err != nil {
+			b.Fatal(err)
+		} else if tok != rmarsh.TokenSymbol {
+			b.Fatalf("Unexpected token %s", tok)
+		} else if !bytes.Equal(data, exp) {
+			b.Fatalf("%s != test", data)
+		}
+		if tok, _, _, err := p.Read(); err != nil {
+			b.Fatal(err)
+		} else if tok != rmarsh.TokenEndArray {
+			b.Fatalf("Unexpected token %s", tok)
+		}
+	}
+}
+
+func TestParserHash(t *testing.T) {
+	p := parseFromRuby(t, "{}")
+	if _, n := expectToken(t, p, rmarsh.TokenStartHash); n != 0 {
+		t.Errorf("Hash length %d, expected 0", n)
+	}
+	expectToken(t, p, rmarsh.TokenEndHash)
+	expectToken(t, p, rmarsh.TokenEOF)
+
+	p = parseFromRuby(t, "{:foo => 123}")
+	if _, n := expectToken(t, p, rmarsh.TokenStartHash); n != 1 {
+		t.Errorf("Hash length %d, expected 1", n)
+	}
+	expectToken(t, p, rmarsh.TokenSymbol)
+	expectToken(t, p, rmarsh.TokenFixnum)
+	expectToken(t, p, rmarsh.TokenEndHash)
+	expectToken(t, p, rmarsh.TokenEOF)
+
+	p = parseFromRuby(t, "{{} => 123}")
+	expectToken(t, p, rmarsh.TokenStartHash)
+	expectToken(t, p, rmarsh.TokenStartHash)
+	expectToken(t, p, rmarsh.TokenEndHash)
+	expectToken(t, p, rmarsh.TokenFixnum)
+	expectToken(t, p, rmarsh.TokenEndHash)
+	expectToken(t, p, rmarsh.TokenEOF)
+}
+
+// Hash lengths and link ids of 123 or more are encoded as multi-byte longs.
+func TestParserHashLongs(t *testing.T) {
+	for _, sz := range []int{122, 123, 300} {
+		raw := genSentinel(t, func(gen *rmarsh.Generator) error {
+			if err := gen.StartHash(sz); err != nil {
+				return err
+			}
+			for i := 0; i < sz; i++ {
+				if err := gen.Fixnum(int64(i)); err != nil {
+					return err
+				}
+				if err := gen.Nil(); err != nil {
+					return err
+				}
+			}
+			return gen.EndHash()
+		})
+		p := rmarsh.NewParser(bytes.NewReader(raw))
+		expectToken(t, p, rmarsh.TokenStartArray)
+		if _, n := expectToken(t, p, rmarsh.TokenStartHash); n != sz {
+			t.Errorf("Hash length %d, expected %d", n, sz)
+		}
+		for i := 0; i < sz; i++ {
+			if _, n := expectToken(t, p, rmarsh.TokenFixnum); n != i {
+				t.Errorf("Hash key %d, expected %d", n, i)
+			}
+			expectToken(t, p, rmarsh.TokenNil)
+		}
+		expectToken(t, p, rmarsh.TokenEndHash)
+		expectSentinel(t, p)
+	}
+
+	// [{0 => 1.0, ..., 199 => 1.0, 200 => @150}, true], with 200 floats taking link ids 2 to 201.
+	raw := []byte{0x04, 0x08, '[', 0x07, '{'}
+	raw = append(raw, genLong(t, 201)[3:]...)
+	for i := 0; i < 200; i++ {
+		raw = append(raw, genLong(t, int64(i))[2:]...)
+		raw = append(raw, 'f', 0x06, '1')
+	}
+	raw = append(raw, genLong(t, 200)[2:]...)
+	raw = append(raw, '@')
+	raw = append(raw, genLong(t, 150)[3:]...)
+	raw = append(raw, 'T')
+	p := rmarsh.NewParser(bytes.NewReader(raw))
+	expectToken(t, p, rmarsh.TokenStartArray)
+	expectToken(t, p, rmarsh.TokenStartHash)
+	for i := 0; i < 200; i++ {
+		expectToken(t, p, rmarsh.TokenFixnum)
+		expectToken(t, p, rmarsh.TokenFloat)
+	}
+	expectToken(t, p, rmarsh.TokenFixnum)
+	expectToken(t, p, rmarsh.TokenLink)
+	if p.LinkID() != 150 {
+		t.Errorf("Link to %d, expected 150", p.LinkID())
+	}
+	expectToken(t, p, rmarsh.TokenEndHash)
+	expectSentinel(t, p)
+}
+
+func BenchmarkParserHash(b *testing.B) {
+	buf := newCyclicReader(rbEncode(b, "{:foo => 123}"))
+	p := rmarsh.NewParser(buf)
+	exp := []rmarsh.Token{rmarsh.TokenStartHash, rmarsh.TokenSymbol, rmarsh.TokenFixnum, rmarsh.TokenEndHash}
+
+	for i := 0; i < b.N; i++ {
+		p.Reset(nil)
+
+		for _, e := range exp {
+			if tok, _, _, err := p.Read(); err != nil {
+				b.Fatal(err)
+			} else if tok != e {
+				b.Fatalf("Unexpected token %s", tok)
+			}
+		}
+	}
+}
+
+// Arrays are linkable, and links can refer back to an enclosing array.
+func TestParserArrayLinks(t *testing.T) {
+	p := rmarsh.NewParser(bytes.NewReader([]byte{0x04, 0x08, '[', 0x07, 'f', 0x06, '1', '@', 0x00}))
+	expectToken(t, p, rmarsh.TokenStartArray)
+	if p.LinkID() != 0 {
+		t.Errorf("Array link id %d, expected 0", p.LinkID())
+	}
+	expectToken(t, p, rmarsh.TokenFloat)
+	if p.LinkID() != 1 {
+		t.Errorf("Float link id %d, expected 1", p.LinkID())
+	}
+	expectToken(t, p, rmarsh.TokenLink)
+	if p.LinkID() != 0 {
+		t.Errorf("Link to %d, expected 0", p.LinkID())
+	}
+	expectToken(t, p, rmarsh.TokenEndArray)
+	if p.LinkID() != -1 {
+		t.Errorf("End of array has link id %d", p.LinkID())
+	}
+	expectToken(t, p, rmarsh.TokenEOF)
+}
+
+// Array lengths, fixnums, symlink and link ids of 123 or more are encoded as multi-byte longs.
+func TestParserArrayLongs(t *testing.T) {
+	for _, sz := range []int{122, 123, 300} {
+		raw := genSentinel(t, func(gen *rmarsh.Generator) error {
+			if err := gen.StartArray(sz); err != nil {
+				return err
+			}
+			for i := 0; i < sz; i++ {
+				if err := gen.Nil(); err != nil {
+					return err
+				}
+			}
+			return gen.EndArray()
+		})
+		p := rmarsh.NewParser(bytes.NewReader(raw))
+		expectToken(t, p, rmarsh.TokenStartArray)
+		if _, n := expectToken(t, p, rmarsh.TokenStartArray); n != sz {
+			t.Errorf("Array length %d, expected %d", n, sz)
+		}
+		for i := 0; i < sz; i++ {
+			expectToken(t, p, rmarsh.TokenNil)
+		}
+		expectToken(t, p, rmarsh.TokenEndArray)
+		expectSentinel(t, p)
+	}
+
+	// [:s0, ..., :s129, 1000, :s125, true]
+	b := new(bytes.Buffer)
+	gen := rmarsh.NewGenerator(b)
+	if err := gen.StartArray(133); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 130; i++ {
+		if err := gen.Symbol(fmt.Sprintf("s%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := gen.Fixnum(1000); err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.Symbol("s125"); err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.Bool(true); err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.EndArray(); err != nil {
+		t.Fatal(err)
+	}
+	p := rmarsh.NewParser(bytes.NewReader(b.Bytes()))
+	expectToken(t, p, rmarsh.TokenStartArray)
+	for i := 0; i < 130; i++ {
+		expectToken(t, p, rmarsh.TokenSymbol)
+	}
+	if _, n := expectToken(t, p, rmarsh.TokenFixnum); n != 1000 {
+		t.Errorf("Fixnum %d, expected 1000", n)
+	}
+	if sym, _ := expectToken(t, p, rmarsh.TokenSymbol); string(sym) != "s125" {
+		t.Errorf("Symlink resolved to %q, expected s125", sym)
+	}
+	expectSentinel(t, p)
+
+	// [1.0, ..., 1.0, @150, true], with 200 floats taking link ids 1 to 200.
+	raw := append([]byte{0x04, 0x08, '['}, genLong(t, 202)[3:]...)
+	for i := 0; i < 200; i++ {
+		raw = append(raw, 'f', 0x06, '1')
+	}
+	raw = append(raw, '@')
+	raw = append(raw, genLong(t, 150)[3:]...)
+	raw = append(raw, 'T')
+	p = rmarsh.NewParser(bytes.NewReader(raw))
+	expectToken(t, p, rmarsh.TokenStartArray)
+	for i := 0; i < 200; i++ {
+		expectToken(t, p, rmarsh.TokenFloat)
+	}
+	expectToken(t, p, rmarsh.TokenLink)
+	if p.LinkID() != 150 {
+		t.Errorf("Link to %d, expected 150", p.LinkID())
+	}
+	expectSentinel(t, p)
+}
+
+func TestParserTee(t *testing.T) {
+	for _, fixture := range fixtures {
+		raw, err := ioutil.ReadFile(fixturePath(fixture.name, ".marshal"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var tee bytes.Buffer
+		p := rmarsh.NewParser(bytes.NewReader(raw))
+		p.Tee(&tee)
+		if _, err := dumpTokens(p); err != nil {
+			t.Fatalf("Fixture %s: %s", fixture.name, err)
+		}
+		if !bytes.Equal(tee.Bytes(), raw) {
+			t.Errorf("Fixture %s: tee received %x, expected %x", fixture.name, tee.Bytes(), raw)
+		}
+	}
+}
+
+func TestParserInt64(t *testing.T) {
+	// The largest value a 4 byte long can hold, which Ruby will happily load as a Fixnum on 64-bit platforms.
+	raw := []byte{0x04, 0x08, 'i', 0x04, 0xFF, 0xFF, 0xFF, 0xFF}
+	const exp int64 = 0xFFFFFFFF
+	p := rmarsh.NewParser(bytes.NewReader(raw))
+	tok, _, n, err := p.Read()
+	if tok != rmarsh.TokenFixnum {
+		t.Fatalf("Unexpected token %s", tok)
+	}
+	if strconv.IntSize == 32 {
+		if err != rmarsh.ErrFixnumOverflow {
+			t.Fatalf("Unexpected err %v", err)
+		}
+	} else if err != nil {
+		t.Fatal(err)
+	} else if int64(n) != exp {
+		t.Fatalf("Read num %d, expected %d", n, exp)
+	}
+	if p.Int64() != exp {
+		t.Fatalf("p.Int64() = %d, expected %d", p.Int64(), exp)
+	}
+	expectToken(t, p, rmarsh.TokenEOF)
+}
+
+func TestParserNegativeLength(t *testing.T) {
+	raw := []byte{0x04, 0x08, ':', 0xFA, 'x'}
+	p := rmarsh.NewParser(bytes.NewReader(raw))
+	if _, _, _, err := p.Read(); err == nil || err.Error() != "Invalid symbol length -1" {
+		t.Fatalf("Unexpected err %v", err)
+	}
+}
+
+func TestParserSaveRestore(t *testing.T) {
+	raw := []byte{0x04, 0x08, ':', 0x06, 'a'}
+	var tee bytes.Buffer
+	p := rmarsh.NewParser(bytes.NewReader(raw))
+	p.Tee(&tee)
+	// Restoring must forget the symbol, otherwise reading it again would exceed the limit.
+	p.SetMaxSymbolTable(1)
+
+	m := p.Save()
+	for i := 0; i < 3; i++ {
+		if b, _ := expectToken(t, p, rmarsh.TokenSymbol); string(b) != "a" {
+			t.Fatalf("Read symbol %q", b)
+		}
+		expectToken(t, p, rmarsh.TokenEOF)
+		if err := p.Restore(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !bytes.Equal(tee.Bytes(), raw) {
+		t.Errorf("Stream was read more than once: %X", tee.Bytes())
+	}
+
+	p.Reset(bytes.NewReader(raw))
+	if err := p.Restore(m); err != rmarsh.ErrStaleMark {
+		t.Errorf("Unexpected err %v", err)
+	}
+}
+
+func TestParserTableLimits(t *testing.T) {
+	tests := []struct {
+		raw   []byte
+		limit string
+		tok   rmarsh.Token
+		set   func(p *rmarsh.Parser)
+	}{
+		// [:a, :b]
+		{[]byte{0x04, 0x08, '[', 0x07, ':', 0x06, 'a', ':', 0x06, 'b'}, "symbol table", rmarsh.TokenSymbol,
+			func(p *rmarsh.Parser) { p.SetMaxSymbolTable(1) }},
+		// [1.0, 2.0], where the array itself takes the first link id.
+		{[]byte{0x04, 0x08, '[', 0x07, 'f', 0x06, '1', 'f', 0x06, '2'}, "link table", rmarsh.TokenFloat,
+			func(p *rmarsh.Parser) { p.SetMaxLinkTable(2) }},
+	}
+	for _, test := range tests {
+		p := rmarsh.NewParser(bytes.NewReader(test.raw))
+		test.set(p)
+		expectToken(t, p, rmarsh.TokenStartArray)
+		expectToken(t, p, test.tok)
+
+		_, _, _, err := p.Read()
+		lerr, ok := err.(rmarsh.LimitError)
+		if !ok {
+			t.Fatalf("%s: unexpected err %v", test.limit, err)
+		}
+		if lerr.Limit != test.limit || lerr.Offset != 7 {
+			t.Errorf("%s: unexpected LimitError %+v", test.limit, lerr)
+		}
+		if !errors.Is(err, rmarsh.ErrLimitExceeded) {
+			t.Errorf("%s: error %v is not ErrLimitExceeded", test.limit, err)
+		}
+	}
+}
+
+func TestParserErrorClasses(t *testing.T) {
+	tests := []struct {
+		raw []byte
+		exp error
+	}{
+		{[]byte{0x04, 0x07, '0'}, rmarsh.ErrBadMagic},
+		{[]byte{0x04, 0x08, 0xFF}, rmarsh.ErrUnknownType},
+		{[]byte{0x04, 0x08, ':', 0xFA, 'x'}, rmarsh.ErrBadLength},
+		{[]byte{0x04, 0x08, '@', 0x00}, rmarsh.ErrBadLink},
+		{[]byte{0x04, 0x08, ':', 0x06}, rmarsh.ErrTruncated},
+	}
+	for _, test := range tests {
+		p := rmarsh.NewParser(bytes.NewReader(test.raw))
+		_, _, _, err := p.Read()
+		if !errors.Is(err, test.exp) {
+			t.Errorf("%X: error %v is not %v", test.raw, err, test.exp)
+		}
+		var perr rmarsh.ParserError
+		if test.exp != rmarsh.ErrTruncated && !errors.As(err, &perr) {
+			t.Errorf("%X: error %v is not a ParserError", test.raw, err)
+		}
+	}
+
+	var err error = rmarsh.LimitError{Limit: "symbol table", Max: 1}
+	if !errors.Is(err, rmarsh.ErrLimitExceeded) {
+		t.Errorf("LimitError is not ErrLimitExceeded")
+	}
+}
+
+// An io.Reader is permitted to return io.EOF alongside the final bytes of a stream, as the compress/flate reader used by
+// NewDecompressor does.
+func TestParserEOFWithData(t *testing.T) {
+	// [1, :a]
+	raw := []byte{0x04, 0x08, '[', 0x07, 'i', 0x06, ':', 0x06, 'a'}
+	p := rmarsh.NewParser(iotest.DataErrReader(bytes.NewReader(raw)))
+	expectToken(t, p, rmarsh.TokenStartArray)
+	expectToken(t, p, rmarsh.TokenFixnum)
+	expectToken(t, p, rmarsh.TokenSymbol)
+	expectToken(t, p, rmarsh.TokenEndArray)
+	expectToken(t, p, rmarsh.TokenEOF)
+
+	// A stream that's cut short is still truncated.
+	p = rmarsh.NewParser(iotest.DataErrReader(bytes.NewReader(raw[:len(raw)-1])))
+	expectToken(t, p, rmarsh.TokenStartArray)
+	expectToken(t, p, rmarsh.TokenFixnum)
+	if _, _, _, err := p.Read(); !errors.Is(err, rmarsh.ErrTruncated) {
+		t.Errorf("Unexpected error %v, expected %v", err, rmarsh.ErrTruncated)
+	}
+}
+
+func TestParserDebugDump(t *testing.T) {
+	raw := []byte{0x04, 0x08, '@', 0x06}
+	p := rmarsh.NewParser(bytes.NewReader(raw))
+	_, _, _, err := p.Read()
+	perr, ok := err.(rmarsh.ParserError)
+	if !ok {
+		t.Fatalf("Unexpected err %v", err)
+	}
+
+	if dump := p.DebugDump(perr.Offset, 1); dump != "00000001  08 40\n" {
+		t.Errorf("Unexpected dump %q", dump)
+	}
+	if dump := p.DebugDump(perr.Offset, 100); dump != "00000000  04 08 40 06\n" {
+		t.Errorf("Unexpected dump %q", dump)
+	}
+}
+
+func TestParserTraceTo(t *testing.T) {
+	var trace bytes.Buffer
+	p := rmarsh.NewParser(bytes.NewReader([]byte{0x04, 0x08, ':', 0x06, 'a'}))
+	p.TraceTo(&trace)
+	expectToken(t, p, rmarsh.TokenSymbol)
+	expectToken(t, p, rmarsh.TokenEOF)
+
+	p.Reset(bytes.NewReader([]byte{0x04, 0x08, '@', 0x06}))
+	if _, _, _, err := p.Read(); err == nil {
+		t.Fatal("Expected error")
+	}
+
+	exp := "2\tTokenSymbol \"a\"\n5\tEOF\n2\terror: Invalid link id 1, 0 linkable objects seen\n"
+	if trace.String() != exp {
+		t.Errorf("Unexpected trace %q", trace.String())
+	}
+}
+
+func TestParserSymbolsAsStrings(t *testing.T) {
+	p := rmarsh.NewParser(bytes.NewReader([]byte{0x04, 0x08, ':', 0x08, 'f', 'o', 'o'}))
+	p.SetSymbolsAsStrings(true)
+	tok, b, _, err := p.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tok != rmarsh.TokenString || string(b) != "foo" {
+		t.Errorf("Read %s %q, expected TokenString \"foo\"", tok, b)
+	}
+	expectToken(t, p, rmarsh.TokenEOF)
+
+	p.Reset(bytes.NewReader([]byte{0x04, 0x08, ';', 0x00}))
+	if _, _, _, err := p.Read(); !errors.Is(err, rmarsh.ErrBadLink) {
+		t.Errorf("Expected ErrBadLink, got %v", err)
+	}
+}
+
+// genFixnums generates an array of 1000 fixnums, of every encoded length.
+func genFixnums(tb testing.TB) []byte {
+	return genStream(tb, func(gen *rmarsh.Generator) error {
+		if err := gen.StartArray(1000); err != nil {
+			return err
+		}
+		for i := 0; i < 1000; i++ {
+			if err := gen.Fixnum(int64(i-500) * int64(i) * 997); err != nil {
+				return err
+			}
+		}
+		return gen.EndArray()
+	})
+}
+
+// genSymbolStringHash generates a hash of 100 distinct symbols to strings. As Ruby does, each string is wrapped in an
+// ivar marking it as UTF-8.
+func genSymbolStringHash(tb testing.TB) []byte {
+	return genStream(tb, func(gen *rmarsh.Generator) error {
+		if err := gen.StartHash(100); err != nil {
+			return err
+		}
+		for i := 0; i < 100; i++ {
+			if err := gen.Symbol("key_" + strconv.Itoa(i)); err != nil {
+				return err
+			}
+			if err := gen.StartIVar(1); err != nil {
+				return err
+			}
+			if err := gen.String("value " + strconv.Itoa(i)); err != nil {
+				return err
+			}
+			if err := gen.Symbol("E"); err != nil {
+				return err
+			}
+			if err := gen.Bool(true); err != nil {
+				return err
+			}
+			if err := gen.EndIVar(); err != nil {
+				return err
+			}
+		}
+		return gen.EndHash()
+	})
+}
+
+// Reading primitive values should not allocate once the Parser has warmed up.
+func TestParserAllocs(t *testing.T) {
+	streams := map[string][]byte{
+		"fixnums":            genFixnums(t),
+		"symbol_string_hash": genSymbolStringHash(t),
+	}
+	for _, name := range []string{"nil", "fixnum_max", "fixnum_min", "float", "symbol", "array_nested", "array_symlink", "hash", "string"} {
+		raw, err := ioutil.ReadFile(fixturePath(name, ".marshal"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		streams[name] = raw
+	}
+
+	for name, raw := range streams {
+		r := bytes.NewReader(raw)
+		p := rmarsh.NewParser(r)
+
+		allocs := testing.AllocsPerRun(100, func() {
+			r.Reset(raw)
+			p.Reset(nil)
+			for {
+				tok, _, _, err := p.Read()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if tok == rmarsh.TokenEOF {
+					break
+				}
+			}
+		})
+		if allocs > 0 {
+			t.Errorf("Stream %s: %v allocations per read", name, allocs)
+		}
+	}
+}
+
+func benchmarkParserStream(b *testing.B, raw []byte) {
+	r := bytes.NewReader(raw)
+	p := rmarsh.NewParser(r)
+	b.SetBytes(int64(len(raw)))
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		r.Reset(raw)
+		p.Reset(nil)
+		for {
+			tok, _, _, err := p.Read()
+			if err != nil {
+				b.Fatal(err)
+			}
+			if tok == rmarsh.TokenEOF {
+				break
+			}
+		}
+	}
+}
+
+func BenchmarkParserFixnums(b *testing.B) {
+	benchmarkParserStream(b, genFixnums(b))
+}
+
+func BenchmarkParserSymbolStringHash(b *testing.B) {
+	benchmarkParserStream(b, genSymbolStringHash(b))
+}
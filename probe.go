@@ -0,0 +1,155 @@
+package rmarsh
+
+import (
+	"bufio"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// ProbeResult describes the envelope of a Marshal stream, as reported by Probe.
+type ProbeResult struct {
+	Major, Minor int // Version of the Marshal format, from the stream header.
+
+	// Type of the top level value, e.g "Hash" or "String". Ivars, extended modules and user subclasses are unwrapped,
+	// so an instance of a Hash subclass is reported as a Hash, with Class set to the name of the subclass.
+	Type  string
+	Class string // Class of the top level value, if it names one.
+	Len   int    // Declared length of a top level String, Regexp, Symbol, Array, Hash, object or struct, or -1.
+
+	// HasObjects is set if anything in the stream names a class or module: objects, structs, user defined and user
+	// marshalled types, user subclasses of core types, extended modules, or plain Class and Module values. Streams
+	// without any of those can be loaded without instantiating arbitrary Ruby classes.
+	HasObjects bool
+}
+
+// errProbeDone is used internally to stop the scanner once Probe has what it needs.
+var errProbeDone = errors.New("probe done")
+
+// Probe reads a Marshal stream from r and reports its version, the type of its top level value, and whether it
+// contains any objects. This allows payloads to be classified (e.g routed to a suitable consumer) without decoding them.
+// Probe skips over the contents of Strings and Regexps rather than holding on to them, and stops reading as soon as the
+// rest of the stream can't change the result: once the shape of the top level value is known and an object has been
+// found. Whatever follows that point isn't validated. A stream without objects has to be read to the end.
+// If the stream has a version other than 4.8, Probe returns an error along with a ProbeResult that only reports the
+// version. Reads from r are buffered, so bytes past the end of the Marshal stream may be consumed.
+func Probe(r io.Reader) (*ProbeResult, error) {
+	res := &ProbeResult{Len: -1}
+	p := prober{res: res}
+	s := scanner{r: bufio.NewReader(r), visit: &p, skim: true}
+	s.limits.AllowClass = func(string) bool {
+		res.HasObjects = true
+		return true
+	}
+
+	hdr, err := s.r.Peek(len(magic))
+	if len(hdr) < len(magic) {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, errors.Wrap(err, "probe")
+	}
+	res.Major, res.Minor = int(hdr[0]), int(hdr[1])
+	if hdr[0] != magic[0] || hdr[1] != magic[1] {
+		return res, errors.Errorf("unsupported Marshal version %d.%d", res.Major, res.Minor)
+	}
+	s.r.Discard(len(magic))
+	s.report.Size = len(magic)
+
+	if err := s.value(); err != nil && err != errScanStop && err != errProbeDone {
+		return nil, err
+	}
+	if !s.report.Valid() {
+		return nil, errors.Errorf("invalid Marshal stream: %s", s.report.Findings[0])
+	}
+
+	top := p.top
+	res.Type = typeName(top.typ)
+	switch top.typ {
+	case typeSymlink:
+		res.Type = typeName(typeSymbol)
+	case typeString, typeRegExp, typeSymbol, typeArray, typeHash, typeHashDef, typeObject, typeStruct:
+		res.Len = top.len
+	}
+	switch top.typ {
+	case typeObject, typeStruct, typeUsrMarshal, typeData, typeUsrDef:
+		if res.Class == "" {
+			res.Class = top.sym
+		}
+	}
+	return res, nil
+}
+
+// A prober follows the elements read by a scanner to find the top level value, and stops the scan once its shape is
+// known, if the stream is already known to contain objects.
+type prober struct {
+	res    *ProbeResult
+	frames []probeFrame // elements currently being read, innermost last
+	top    *scanElem    // the top level value, once it has begun
+	topIdx int          // index of the frame of the top level value
+	done   bool         // set once the top level value has been read
+}
+
+type probeFrame struct {
+	e    *scanElem
+	wrap bool // set for the ivar, extended and user class wrappers of the top level value
+	kids int  // number of elements nested in this one so far
+}
+
+func (p *prober) begin(e *scanElem) error {
+	// The top level value is the first element that isn't a wrapper, or the value wrapped by one of its wrappers.
+	onTop := len(p.frames) == 0
+	if !onTop {
+		f := &p.frames[len(p.frames)-1]
+		// Extended and user class wrappers name a module or class before the value they wrap.
+		onTop = f.wrap && (f.e.typ == typeIvar && f.kids == 0 || f.e.typ != typeIvar && f.kids == 1)
+		f.kids++
+	}
+	wrap := e.typ == typeIvar || e.typ == typeExtended || e.typ == typeUClass
+	p.frames = append(p.frames, probeFrame{e: e, wrap: onTop && wrap})
+	if !onTop || wrap {
+		return p.stop()
+	}
+
+	p.top, p.topIdx = e, len(p.frames)-1
+	// A user class wrapper names the class of the value it wraps. The outermost one wins, as it does in Ruby.
+	for i := p.topIdx - 1; i >= 0; i-- {
+		if p.frames[i].e.typ == typeUClass {
+			p.res.Class = p.frames[i].e.sym
+		}
+	}
+	return nil
+}
+
+func (p *prober) linked(e *scanElem) {}
+
+func (p *prober) end(e *scanElem) error {
+	p.frames = p.frames[:len(p.frames)-1]
+	if e == p.top {
+		p.done = true
+	}
+	return p.stop()
+}
+
+// stop ends the scan once the rest of the stream can't change the result of the probe.
+func (p *prober) stop() error {
+	if !p.res.HasObjects || p.top == nil {
+		return nil
+	}
+	if !p.done {
+		kids := p.frames[p.topIdx].kids
+		switch p.top.typ {
+		case typeObject, typeStruct, typeUsrMarshal, typeData, typeUsrDef:
+			// These begin with their class name, and objects and structs declare their length after it.
+			if kids < 2 {
+				return nil
+			}
+		default:
+			// Arrays and Hashes declare their length before their elements.
+			if kids < 1 {
+				return nil
+			}
+		}
+	}
+	return errProbeDone
+}
@@ -0,0 +1,93 @@
+package rmarsh_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/samcday/rmarsh"
+)
+
+func TestProbe(t *testing.T) {
+	tests := []struct {
+		raw []byte
+		exp rmarsh.ProbeResult
+	}{
+		// "abc" with UTF-8 encoding.
+		{
+			[]byte{0x04, 0x08, 'I', '"', 0x08, 'a', 'b', 'c', 0x06, ':', 0x06, 'E', 'T'},
+			rmarsh.ProbeResult{Major: 4, Minor: 8, Type: "String", Len: 3},
+		},
+		// [1, {}]
+		{
+			[]byte{0x04, 0x08, '[', 0x07, 'i', 0x06, '{', 0x00},
+			rmarsh.ProbeResult{Major: 4, Minor: 8, Type: "Array", Len: 2},
+		},
+		// {:a => Foo.allocate}
+		{
+			[]byte{0x04, 0x08, '{', 0x06, ':', 0x06, 'a', 'o', ':', 0x08, 'F', 'o', 'o', 0x00},
+			rmarsh.ProbeResult{Major: 4, Minor: 8, Type: "Hash", Len: 1, HasObjects: true},
+		},
+		// An instance of Foo < Array.
+		{
+			[]byte{0x04, 0x08, 'C', ':', 0x08, 'F', 'o', 'o', '[', 0x00},
+			rmarsh.ProbeResult{Major: 4, Minor: 8, Type: "Array", Class: "Foo", Len: 0, HasObjects: true},
+		},
+		{
+			[]byte{0x04, 0x08, 'i', 0x06},
+			rmarsh.ProbeResult{Major: 4, Minor: 8, Type: "Fixnum", Len: -1},
+		},
+	}
+	for _, test := range tests {
+		res, err := rmarsh.Probe(bytes.NewReader(test.raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if *res != test.exp {
+			t.Errorf("Probe(%X) = %+v, expected %+v", test.raw, *res, test.exp)
+		}
+	}
+
+	res, err := rmarsh.Probe(bytes.NewReader([]byte{0x04, 0x09, '0'}))
+	if err == nil || res == nil || res.Minor != 9 {
+		t.Errorf("Unexpected result %+v, %v", res, err)
+	}
+}
+
+// Probe stops once the shape of the top level value is known and an object has been found, so it doesn't notice
+// problems in the rest of the stream.
+func TestProbeStopsEarly(t *testing.T) {
+	tests := []struct {
+		raw []byte
+		exp rmarsh.ProbeResult
+	}{
+		// [Foo.allocate, <unknown type>]
+		{
+			[]byte{0x04, 0x08, '[', 0x07, 'o', ':', 0x08, 'F', 'o', 'o', 0x00, 0xFF},
+			rmarsh.ProbeResult{Major: 4, Minor: 8, Type: "Array", Len: 2, HasObjects: true},
+		},
+		// An instance of Foo < String, with a truncated ivar list.
+		{
+			[]byte{0x04, 0x08, 'I', 'C', ':', 0x08, 'F', 'o', 'o', '"', 0x06, 'x', 0x06},
+			rmarsh.ProbeResult{Major: 4, Minor: 8, Type: "String", Class: "Foo", Len: 1, HasObjects: true},
+		},
+		// A Foo with an ivar holding an unknown type. Its length is only known once its class name has been read.
+		{
+			[]byte{0x04, 0x08, 'o', ':', 0x08, 'F', 'o', 'o', 0x06, ':', 0x06, 'a', 0xFF},
+			rmarsh.ProbeResult{Major: 4, Minor: 8, Type: "Object", Class: "Foo", Len: 1, HasObjects: true},
+		},
+	}
+	for _, test := range tests {
+		res, err := rmarsh.Probe(bytes.NewReader(test.raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if *res != test.exp {
+			t.Errorf("Probe(%X) = %+v, expected %+v", test.raw, *res, test.exp)
+		}
+	}
+
+	// Without any objects, the whole stream has to be read.
+	if _, err := rmarsh.Probe(bytes.NewReader([]byte{0x04, 0x08, '[', 0x07, 'i', 0x06, 0xFF})); err == nil {
+		t.Error("Expected error for unknown type")
+	}
+}
@@ -0,0 +1,171 @@
+package rmarsh
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// RedactPlaceholder is the String that Redact replaces values with, unless RedactRules specifies another.
+const RedactPlaceholder = "[REDACTED]"
+
+// RedactRules selects the values that Redact replaces.
+type RedactRules struct {
+	// Paths of values to redact, in the form used by Index.Paths (e.g `[:user].@password`).
+	Paths []string
+	// Keys names hash keys (Symbols or Strings), instance variables and struct members whose values are redacted
+	// wherever they appear in the stream, e.g "password". The leading @ of an instance variable is optional.
+	Keys []string
+	// Placeholder is the String that values are replaced with. RedactPlaceholder is used if it's empty.
+	Placeholder string
+}
+
+// suffixes returns the path components that select a value by one of the configured keys.
+func (rules *RedactRules) suffixes() []string {
+	var sfx []string
+	for _, k := range rules.Keys {
+		k = strings.TrimPrefix(k, "@")
+		sfx = append(sfx, "[:"+k+"]", "["+strconv.Quote(k)+"]", "."+k, ".@"+k)
+	}
+	return sfx
+}
+
+func (rules *RedactRules) match(path string, suffixes []string) bool {
+	for _, p := range rules.Paths {
+		if p == path {
+			return true
+		}
+	}
+	for _, sfx := range suffixes {
+		if strings.HasSuffix(path, sfx) {
+			return true
+		}
+	}
+	return false
+}
+
+// Redact copies a complete Marshal stream from r to w, replacing the values selected by rules with a placeholder
+// String. This allows debug dumps of session and cache data to be shared without leaking passwords, tokens and the
+// like. Everything else is copied byte for byte, except for symlinks and links, which are renumbered to account for
+// the symbols and objects that were removed. A symbol that was defined within a redacted value is defined again where
+// it's next used, and links into a redacted value point at its placeholder instead.
+// If the value selected by a rule is itself a link to an object seen earlier in the stream, only the link is replaced.
+func Redact(w io.Writer, r io.Reader, rules RedactRules) error {
+	raw, err := ioutil.ReadAll(r)
+	if err != nil {
+		return errors.Wrap(err, "redact")
+	}
+
+	var refs []extractEvent
+	s := scanner{r: bufio.NewReader(bytes.NewReader(raw)), record: true, paths: make(map[string]Span)}
+	s.onRef = func(typ byte, id, beg, end int) error {
+		refs = append(refs, extractEvent{beg, end, typ, id})
+		return nil
+	}
+	if err := s.stream(); err != nil && err != errScanStop {
+		return err
+	}
+	if !s.report.Valid() {
+		return errors.Errorf("invalid Marshal stream: %s", s.report.Findings[0])
+	}
+
+	// Objects registered at the same offset a redacted value begins belong to an enclosing value, so they go first.
+	// Symbols at that offset belong to the redacted value, so they go after it.
+	var evts []extractEvent
+	for id, obj := range s.objs {
+		evts = append(evts, extractEvent{off: obj.reg, typ: typeObject, id: id})
+	}
+	// Redacted values are marked with the type of their placeholder.
+	sfx := rules.suffixes()
+	for path, span := range s.paths {
+		if rules.match(path, sfx) {
+			evts = append(evts, extractEvent{off: span.Offset, end: span.Offset + span.Len, typ: typeString})
+		}
+	}
+	for id, off := range s.symOffs {
+		evts = append(evts, extractEvent{off: off, typ: typeSymbol, id: id})
+	}
+	evts = append(evts, refs...)
+	sort.SliceStable(evts, func(i, j int) bool { return evts[i].off < evts[j].off })
+
+	ph := rules.Placeholder
+	if ph == "" {
+		ph = RedactPlaceholder
+	}
+
+	var out bytes.Buffer
+	var b [fixnumMaxBytes]byte
+	syms, objs := make(map[int]int), make(map[int]int)
+	var nsyms, nobjs int
+	var beg, end, phID int // The redacted value currently being skipped, and the link id of its placeholder.
+	pos := 0
+	for _, evt := range evts {
+		inside := evt.off >= beg && evt.off < end
+
+		switch evt.typ {
+		case typeObject:
+			// Objects are registered after their type byte has been read.
+			if evt.off > beg && evt.off <= end {
+				objs[evt.id] = phID
+			} else {
+				objs[evt.id] = nobjs
+				nobjs++
+			}
+			continue
+
+		case typeString:
+			if inside {
+				continue
+			}
+			out.Write(raw[pos:evt.off])
+			out.WriteByte(typeString)
+			out.Write(b[:putLong(b[:], int64(len(ph)))])
+			out.WriteString(ph)
+			phID = nobjs
+			nobjs++
+			beg, end, pos = evt.off, evt.end, evt.end
+			continue
+
+		case typeSymbol:
+			if !inside {
+				syms[evt.id] = nsyms
+				nsyms++
+			}
+			continue
+		}
+
+		if inside {
+			continue
+		}
+		out.Write(raw[pos:evt.off])
+		pos = evt.end
+
+		if evt.typ == typeLink {
+			out.WriteByte(typeLink)
+			out.Write(b[:putLong(b[:], int64(objs[evt.id]))])
+			continue
+		}
+		if id, ok := syms[evt.id]; ok {
+			out.WriteByte(typeSymlink)
+			out.Write(b[:putLong(b[:], int64(id))])
+			continue
+		}
+		// Symbol was defined within a redacted value, so we define it here instead.
+		sym := s.syms[evt.id]
+		syms[evt.id] = nsyms
+		nsyms++
+		out.WriteByte(typeSymbol)
+		out.Write(b[:putLong(b[:], int64(len(sym)))])
+		out.WriteString(sym)
+	}
+	out.Write(raw[pos:s.report.Size])
+
+	_, err = w.Write(out.Bytes())
+	return err
+}
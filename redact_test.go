@@ -0,0 +1,76 @@
+package rmarsh_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/samcday/rmarsh"
+)
+
+func TestRedact(t *testing.T) {
+	// [{:secret => [:token, 1.5]}, :token, 2.5, <link to 2.5>]
+	raw := []byte{0x04, 0x08, '[', 0x09, '{', 0x06, ':', 0x0b, 's', 'e', 'c', 'r', 'e', 't', '[', 0x07, ':', 0x0a,
+		't', 'o', 'k', 'e', 'n', 'f', 0x08, '1', '.', '5', ';', 0x06, 'f', 0x08, '2', '.', '5', '@', 0x09}
+
+	// [{:secret => "[REDACTED]"}, :token, 2.5, <link to 2.5>]
+	exp := []byte{0x04, 0x08, '[', 0x09, '{', 0x06, ':', 0x0b, 's', 'e', 'c', 'r', 'e', 't', '"', 0x0f, '[', 'R', 'E',
+		'D', 'A', 'C', 'T', 'E', 'D', ']', ':', 0x0a, 't', 'o', 'k', 'e', 'n', 'f', 0x08, '2', '.', '5', '@', 0x08}
+
+	for _, rules := range []rmarsh.RedactRules{
+		{Keys: []string{"secret"}},
+		{Paths: []string{"[0][:secret]"}},
+	} {
+		var b bytes.Buffer
+		if err := rmarsh.Redact(&b, bytes.NewReader(raw), rules); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b.Bytes(), exp) {
+			t.Errorf("Redacted %v to %X, expected %X", rules, b.Bytes(), exp)
+		}
+		if report, err := rmarsh.Validate(bytes.NewReader(b.Bytes()), rmarsh.ValidateLimits{}); err != nil || !report.Valid() {
+			t.Errorf("Redacted stream is invalid: %v %v", err, report.Findings)
+		}
+	}
+}
+
+func TestRedactObject(t *testing.T) {
+	raw := genStream(t, func(gen *rmarsh.Generator) error {
+		if err := gen.StartArray(2); err != nil {
+			return err
+		}
+		if err := gen.StartObject("User", 2); err != nil {
+			return err
+		}
+		if err := gen.Symbol("@name"); err != nil {
+			return err
+		}
+		if err := gen.String("bob"); err != nil {
+			return err
+		}
+		if err := gen.Symbol("@password"); err != nil {
+			return err
+		}
+		if err := gen.String("hunter2"); err != nil {
+			return err
+		}
+		if err := gen.EndObject(); err != nil {
+			return err
+		}
+		if err := gen.String("hunter2"); err != nil {
+			return err
+		}
+		return gen.EndArray()
+	})
+
+	var out bytes.Buffer
+	rules := rmarsh.RedactRules{Keys: []string{"password"}, Placeholder: "***"}
+	if err := rmarsh.Redact(&out, bytes.NewReader(raw), rules); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Count(out.Bytes(), []byte("hunter2")) != 1 || !bytes.Contains(out.Bytes(), []byte("***")) {
+		t.Errorf("Unexpected redaction %q", out.Bytes())
+	}
+	if !bytes.Contains(out.Bytes(), []byte("bob")) {
+		t.Errorf("Unredacted value missing from %q", out.Bytes())
+	}
+}
@@ -0,0 +1,69 @@
+package rmarsh
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// RenameSymbols copies a complete Marshal stream from r to w, renaming symbols according to the provided mapping.
+// Since class names are stored as symbols, this can be used to migrate data between Ruby codebases, e.g renaming
+// "LegacyApp::User" to "App::User". Class and module references (such as the value of User.class) are renamed too.
+// Everything else is copied byte for byte. Note that the mapping applies to every symbol in the stream, including hash
+// keys and instance variable names.
+// If validate is set, every new name in the mapping is checked with IsValidSymbol first, in the same way as a Generator
+// configured with SetSymbolValidation. A new name containing non-ASCII characters is only loaded by Ruby as a UTF-8
+// Symbol if the symbol it replaces was marked as UTF-8 too, since only the name itself is rewritten.
+func RenameSymbols(w io.Writer, r io.Reader, mapping map[string]string, validate bool) error {
+	for _, name := range mapping {
+		if validate && !IsValidSymbol(name) {
+			return errors.Wrapf(ErrInvalidSymbol, "rename to %q", name)
+		}
+	}
+
+	raw, err := ioutil.ReadAll(r)
+	if err != nil {
+		return errors.Wrap(err, "rename")
+	}
+	s := scanner{r: bufio.NewReader(bytes.NewReader(raw)), record: true}
+	if err := s.stream(); err != nil && err != errScanStop {
+		return err
+	}
+	if !s.report.Valid() {
+		return errors.Errorf("invalid Marshal stream: %s", s.report.Findings[0])
+	}
+
+	// Symbols only need to be renamed where they're defined, symlinks to them will follow along.
+	offs := append([]int(nil), s.symOffs...)
+	for _, obj := range s.objs {
+		if (obj.typ == typeClass || obj.typ == typeModule || obj.typ == typeModuleOld) && raw[obj.Offset] == obj.typ {
+			offs = append(offs, obj.Offset)
+		}
+	}
+	sort.Ints(offs)
+
+	var out bytes.Buffer
+	var b [fixnumMaxBytes]byte
+	pos := 0
+	for _, off := range offs {
+		n, sz := getLong(raw[off+1:])
+		end := off + 1 + sz + int(n)
+		name, ok := mapping[string(raw[off+1+sz:end])]
+		if !ok {
+			continue
+		}
+
+		out.Write(raw[pos : off+1])
+		out.Write(b[:putLong(b[:], int64(len(name)))])
+		out.WriteString(name)
+		pos = end
+	}
+	out.Write(raw[pos:s.report.Size])
+
+	_, err = w.Write(out.Bytes())
+	return err
+}
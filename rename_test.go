@@ -0,0 +1,78 @@
+package rmarsh_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/samcday/rmarsh"
+)
+
+// Generates [#<prefix::User @name="x">, #<prefix::User @name="y">, prefix::User] using the given class name prefix.
+func genRenameStream(t *testing.T, prefix string) []byte {
+	return genStream(t, func(gen *rmarsh.Generator) error {
+		if err := gen.StartArray(3); err != nil {
+			return err
+		}
+		if err := gen.StartObject(prefix+"::User", 1); err != nil {
+			return err
+		}
+		if err := gen.Symbol("@name"); err != nil {
+			return err
+		}
+		if err := gen.String("x"); err != nil {
+			return err
+		}
+		if err := gen.EndObject(); err != nil {
+			return err
+		}
+		if err := gen.StartObject(prefix+"::User", 1); err != nil {
+			return err
+		}
+		if err := gen.Symbol("@name"); err != nil {
+			return err
+		}
+		if err := gen.String("y"); err != nil {
+			return err
+		}
+		if err := gen.EndObject(); err != nil {
+			return err
+		}
+		if err := gen.Class(prefix + "::User"); err != nil {
+			return err
+		}
+		return gen.EndArray()
+	})
+}
+
+func TestRenameSymbols(t *testing.T) {
+	var b bytes.Buffer
+	mapping := map[string]string{"LegacyApp::User": "App::User"}
+	if err := rmarsh.RenameSymbols(&b, bytes.NewReader(genRenameStream(t, "LegacyApp")), mapping, false); err != nil {
+		t.Fatal(err)
+	}
+
+	if exp := genRenameStream(t, "App"); !bytes.Equal(b.Bytes(), exp) {
+		t.Fatalf("Renamed stream %x, expected %x", b.Bytes(), exp)
+	}
+}
+
+func TestRenameSymbolsInvalid(t *testing.T) {
+	var b bytes.Buffer
+	if err := rmarsh.RenameSymbols(&b, bytes.NewReader([]byte{0x04, 0x08, ':'}), nil, false); err == nil {
+		t.Fatal("Expected error for truncated stream")
+	}
+	mapping := map[string]string{"a": ""}
+	if err := rmarsh.RenameSymbols(&b, bytes.NewReader([]byte{0x04, 0x08, '0'}), mapping, true); errors.Cause(err) != rmarsh.ErrInvalidSymbol {
+		t.Fatalf("Unexpected error for invalid symbol: %v", err)
+	}
+
+	// Without validation, the empty name is written as it is.
+	b.Reset()
+	if err := rmarsh.RenameSymbols(&b, bytes.NewReader([]byte{0x04, 0x08, ':', 0x06, 'a'}), mapping, false); err != nil {
+		t.Fatal(err)
+	}
+	if exp := []byte{0x04, 0x08, ':', 0x00}; !bytes.Equal(b.Bytes(), exp) {
+		t.Errorf("Renamed stream %x, expected %x", b.Bytes(), exp)
+	}
+}
@@ -0,0 +1,307 @@
+package rmarsh
+
+import (
+	"bufio"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+// Symbols that can be written in Ruby source without quoting.
+var rubyBareSymbol = regexp.MustCompile(`^((@@?|\$)?[A-Za-z_][A-Za-z0-9_]*|[A-Za-z_][A-Za-z0-9_]*[?!=])$`)
+
+// WriteRuby reads a complete Marshal stream from r, and writes Ruby source code to w that evaluates to the same value.
+// This allows a captured payload to be reconstructed in a Ruby console without access to the original bytes.
+// Objects are rebuilt with allocate and instance_variable_set, user defined types with _load, and user marshalled types
+// with marshal_load, so the classes involved must be loaded, but their initializers are never called. Objects that are
+// referred to more than once are assigned to local variables (v1, v2, ...). A cyclic reference can't be expressed as
+// a single Ruby expression though, so it will evaluate to nil.
+// Reads from r are buffered, so bytes past the end of the Marshal stream may be consumed.
+func WriteRuby(w io.Writer, r io.Reader) error {
+	root, err := readTree(r)
+	if err != nil {
+		return err
+	}
+
+	rw := rubyWriter{w: bufio.NewWriter(w), vars: make(map[*node]int)}
+	rw.findLinks(root)
+	rw.value(root)
+	rw.w.WriteByte('\n')
+	return errors.Wrap(rw.w.Flush(), "write Ruby")
+}
+
+type rubyWriter struct {
+	w    *bufio.Writer
+	vars map[*node]int // Variable numbers of objects that are linked to, assigned as they're written.
+	nvar int
+}
+
+// findLinks finds every object in the tree that is the target of a link.
+func (rw *rubyWriter) findLinks(n *node) {
+	if n == nil {
+		return
+	}
+	if n.typ == typeLink {
+		rw.vars[n.ref] = 0
+		return
+	}
+	for _, e := range n.elems {
+		rw.findLinks(e)
+	}
+	for _, v := range n.vars {
+		rw.findLinks(v.val)
+	}
+	rw.findLinks(n.def)
+}
+
+func (rw *rubyWriter) value(n *node) {
+	if n.typ == typeLink {
+		rw.w.WriteString("v" + strconv.Itoa(rw.vars[n.ref]))
+		return
+	}
+
+	_, linked := rw.vars[n]
+	if linked {
+		rw.nvar++
+		rw.vars[n] = rw.nvar
+		rw.w.WriteString("(v" + strconv.Itoa(rw.nvar) + " = ")
+	}
+
+	ivars := n.vars
+	switch n.typ {
+	case typeNil:
+		rw.w.WriteString("nil")
+	case typeTrue:
+		rw.w.WriteString("true")
+	case typeFalse:
+		rw.w.WriteString("false")
+	case typeFixnum:
+		rw.w.WriteString(strconv.Itoa(n.num))
+	case typeSymbol:
+		rw.symbol(string(n.data))
+	case typeFloat:
+		rw.float(n.data)
+
+	case typeBignum:
+		rw.w.WriteString(bignumString(n.num < 0, n.data))
+
+	case typeClass, typeModule, typeModuleOld:
+		rw.w.WriteString(n.class)
+
+	case typeString:
+		if n.class != "" {
+			rw.w.WriteString(n.class + ".new(")
+		}
+		ivars = rw.string(n.data, n.vars)
+		if n.class != "" {
+			rw.w.WriteByte(')')
+		}
+
+	case typeRegExp:
+		if n.class != "" {
+			rw.w.WriteString(n.class + ".new(")
+		} else {
+			rw.w.WriteString("Regexp.new(")
+		}
+		ivars = rw.string(n.data, n.vars)
+		rw.w.WriteString(", " + strconv.Itoa(n.num&(RegexpIgnoreCase|RegexpExtended|RegexpMultiline)) + ")")
+
+	case typeArray:
+		if n.class != "" {
+			rw.w.WriteString(n.class)
+		}
+		rw.w.WriteByte('[')
+		rw.list(n.elems)
+		rw.w.WriteByte(']')
+
+	case typeHash, typeHashDef:
+		if n.class != "" {
+			rw.w.WriteString(n.class + "[")
+		}
+		rw.w.WriteByte('{')
+		for i := 0; i < len(n.elems); i += 2 {
+			if i > 0 {
+				rw.w.WriteString(", ")
+			}
+			rw.value(n.elems[i])
+			rw.w.WriteString(" => ")
+			rw.value(n.elems[i+1])
+		}
+		rw.w.WriteByte('}')
+		if n.class != "" {
+			rw.w.WriteByte(']')
+		}
+		// The default is read after the elements, and may link to one of them.
+		if n.def != nil {
+			rw.w.WriteString(".tap { |h| h.default = ")
+			rw.value(n.def)
+			rw.w.WriteString(" }")
+		}
+
+	case typeObject:
+		rw.w.WriteString(n.class + ".allocate")
+		rw.ivars(n.vars)
+		ivars = nil
+
+	case typeStruct:
+		rw.w.WriteString(n.class + ".new(")
+		for i, v := range n.vars {
+			if i > 0 {
+				rw.w.WriteString(", ")
+			}
+			rw.value(v.val)
+		}
+		rw.w.WriteByte(')')
+		ivars = nil
+
+	case typeUsrMarshal, typeData:
+		method := "marshal_load"
+		if n.typ == typeData {
+			method = "_load_data"
+		}
+		rw.w.WriteString(n.class + ".allocate.tap { |o| o." + method + "(")
+		rw.value(n.elems[0])
+		rw.w.WriteString(") }")
+
+	case typeUsrDef:
+		// The ivars of a user defined type belong to its data.
+		rw.w.WriteString(n.class + "._load(")
+		ivars = rw.string(n.data, n.vars)
+		rw.w.WriteByte(')')
+	}
+
+	rw.ivars(ivars)
+	for i := len(n.exts) - 1; i >= 0; i-- {
+		rw.w.WriteString(".extend(" + n.exts[i] + ")")
+	}
+
+	if linked {
+		rw.w.WriteByte(')')
+	}
+}
+
+func (rw *rubyWriter) list(vals []*node) {
+	for i, v := range vals {
+		if i > 0 {
+			rw.w.WriteString(", ")
+		}
+		rw.value(v)
+	}
+}
+
+// ivars writes a tap block that sets the given instance variables.
+func (rw *rubyWriter) ivars(vars []nodeVar) {
+	if len(vars) == 0 {
+		return
+	}
+	rw.w.WriteString(".tap { |o| ")
+	for i, v := range vars {
+		if i > 0 {
+			rw.w.WriteString("; ")
+		}
+		rw.w.WriteString("o.instance_variable_set(")
+		rw.symbol(v.name)
+		rw.w.WriteString(", ")
+		rw.value(v.val)
+		rw.w.WriteByte(')')
+	}
+	rw.w.WriteString(" }")
+}
+
+func (rw *rubyWriter) symbol(sym string) {
+	rw.w.WriteByte(':')
+	if rubyBareSymbol.MatchString(sym) {
+		rw.w.WriteString(sym)
+		return
+	}
+	rw.quote([]byte(sym), true)
+}
+
+func (rw *rubyWriter) float(b []byte) {
+	// Ancient versions of Ruby appended mantissa bits after a NUL byte.
+	if i := strings.IndexByte(string(b), 0); i >= 0 {
+		b = b[:i]
+	}
+	switch s := string(b); s {
+	case "inf":
+		rw.w.WriteString("Float::INFINITY")
+	case "-inf":
+		rw.w.WriteString("-Float::INFINITY")
+	case "nan":
+		rw.w.WriteString("Float::NAN")
+	default:
+		rw.w.WriteString(s)
+		if !strings.ContainsAny(s, ".e") {
+			rw.w.WriteString(".0")
+		}
+	}
+}
+
+// string writes a String literal with the encoding described by the provided ivars, and returns the remaining ivars.
+func (rw *rubyWriter) string(b []byte, vars []nodeVar) (rest []nodeVar) {
+	enc := ""
+	for _, v := range vars {
+		switch {
+		case v.name == "E" && v.val.typ == typeTrue:
+			enc = "UTF-8"
+		case v.name == "E" && v.val.typ == typeFalse:
+			enc = "US-ASCII"
+		case v.name == "encoding" && v.val.typ == typeString:
+			enc = string(v.val.data)
+		default:
+			rest = append(rest, v)
+		}
+	}
+
+	rw.quote(b, enc == "UTF-8")
+	switch enc {
+	case "UTF-8":
+	case "":
+		rw.w.WriteString(".b")
+	case "US-ASCII":
+		rw.w.WriteString(".force_encoding(Encoding::US_ASCII)")
+	default:
+		rw.w.WriteString(".force_encoding(")
+		rw.quote([]byte(enc), false)
+		rw.w.WriteByte(')')
+	}
+	return
+}
+
+// quote writes a double quoted Ruby string literal. Bytes outside of printable ASCII are escaped, unless utf is set, in
+// which case printable UTF-8 characters are written as is.
+func (rw *rubyWriter) quote(b []byte, utf bool) {
+	rw.w.WriteByte('"')
+	for i := 0; i < len(b); {
+		c := b[i]
+		switch {
+		case c == '"' || c == '\\' || c == '#':
+			rw.w.WriteByte('\\')
+			rw.w.WriteByte(c)
+		case c == '\n':
+			rw.w.WriteString(`\n`)
+		case c == '\t':
+			rw.w.WriteString(`\t`)
+		case c == '\r':
+			rw.w.WriteString(`\r`)
+		case c >= 0x20 && c < 0x7F:
+			rw.w.WriteByte(c)
+		default:
+			if utf && c >= utf8.RuneSelf {
+				if r, sz := utf8.DecodeRune(b[i:]); r != utf8.RuneError && unicode.IsPrint(r) {
+					rw.w.Write(b[i : i+sz])
+					i += sz
+					continue
+				}
+			}
+			rw.w.WriteString(`\x` + strconv.FormatUint(uint64(c)|0x100, 16)[1:])
+		}
+		i++
+	}
+	rw.w.WriteByte('"')
+}
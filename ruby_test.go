@@ -0,0 +1,126 @@
+package rmarsh_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/samcday/rmarsh"
+)
+
+func TestWriteRuby(t *testing.T) {
+	raw := genStream(t, func(gen *rmarsh.Generator) error {
+		if err := gen.StartArray(9); err != nil {
+			return err
+		}
+		if err := gen.Nil(); err != nil {
+			return err
+		}
+		if err := gen.Fixnum(-1); err != nil {
+			return err
+		}
+		if err := gen.Float(1); err != nil {
+			return err
+		}
+		if err := gen.Symbol("foo"); err != nil {
+			return err
+		}
+		if err := gen.Symbol("foo bar"); err != nil {
+			return err
+		}
+		if err := gen.StartIVar(1); err != nil {
+			return err
+		}
+		if err := gen.String("héllo \"#{x}\"\n"); err != nil {
+			return err
+		}
+		if err := gen.Symbol("E"); err != nil {
+			return err
+		}
+		if err := gen.Bool(true); err != nil {
+			return err
+		}
+		if err := gen.EndIVar(); err != nil {
+			return err
+		}
+		if err := gen.String("\xff"); err != nil {
+			return err
+		}
+		if err := gen.StartObject("Foo::Bar", 1); err != nil {
+			return err
+		}
+		if err := gen.Symbol("@baz"); err != nil {
+			return err
+		}
+		if err := gen.StartHash(1); err != nil {
+			return err
+		}
+		if err := gen.Symbol("a"); err != nil {
+			return err
+		}
+		if err := gen.Bool(false); err != nil {
+			return err
+		}
+		if err := gen.EndHash(); err != nil {
+			return err
+		}
+		if err := gen.EndObject(); err != nil {
+			return err
+		}
+		if err := gen.UserDefinedObject("Time", "\x00\x01"); err != nil {
+			return err
+		}
+		return gen.EndArray()
+	})
+
+	var out bytes.Buffer
+	if err := rmarsh.WriteRuby(&out, bytes.NewReader(raw)); err != nil {
+		t.Fatal(err)
+	}
+	exp := `[nil, -1, 1.0, :foo, :"foo bar", "h` + "é" + `llo \"\#{x}\"\n", "\xff".b, ` +
+		`Foo::Bar.allocate.tap { |o| o.instance_variable_set(:@baz, {:a => false}) }, Time._load("\x00\x01".b)]` + "\n"
+	if out.String() != exp {
+		t.Errorf("WriteRuby() =\n%s\nexpected\n%s", out.String(), exp)
+	}
+}
+
+func TestWriteRubyLinks(t *testing.T) {
+	// [[], <link to the first element>, <link to the outer array>]
+	raw := []byte{0x04, 0x08, '[', 0x08, '[', 0x00, '@', 0x06, '@', 0x00}
+
+	var out bytes.Buffer
+	if err := rmarsh.WriteRuby(&out, bytes.NewReader(raw)); err != nil {
+		t.Fatal(err)
+	}
+	if exp := "(v1 = [(v2 = []), v2, v1])\n"; out.String() != exp {
+		t.Errorf("WriteRuby() = %q, expected %q", out.String(), exp)
+	}
+}
+
+func TestWriteRubyHashDefault(t *testing.T) {
+	// {:a => "x"} with a default linking to "x"
+	raw := []byte{0x04, 0x08, '}', 0x06, ':', 0x06, 'a', '"', 0x06, 'x', '@', 0x06}
+
+	var out bytes.Buffer
+	if err := rmarsh.WriteRuby(&out, bytes.NewReader(raw)); err != nil {
+		t.Fatal(err)
+	}
+	if exp := "{:a => (v1 = \"x\".b)}.tap { |h| h.default = v1 }\n"; out.String() != exp {
+		t.Errorf("WriteRuby() = %q, expected %q", out.String(), exp)
+	}
+}
+
+func TestWriteRubyUserDefinedLinks(t *testing.T) {
+	// [<Foo with data "ab" and @x = "y">, <link to the Foo>, <link to "y">]. Ruby links the user defined object after
+	// the ivars of its data.
+	raw := []byte{0x04, 0x08, '[', 0x08, 'I', 'u', ':', 0x08, 'F', 'o', 'o', 0x07, 'a', 'b', 0x06, ':', 0x07, '@', 'x',
+		'"', 0x06, 'y', '@', 0x07, '@', 0x06}
+
+	var out bytes.Buffer
+	if err := rmarsh.WriteRuby(&out, bytes.NewReader(raw)); err != nil {
+		t.Fatal(err)
+	}
+	exp := `[(v1 = Foo._load("ab".b).tap { |o| o.instance_variable_set(:@x, (v2 = "y".b)) }), v1, v2]` + "\n"
+	if out.String() != exp {
+		t.Errorf("WriteRuby() = %q, expected %q", out.String(), exp)
+	}
+}
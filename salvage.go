@@ -0,0 +1,82 @@
+package rmarsh
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+)
+
+// salvageTypes are the types Salvage considers worth recovering. Anything smaller is too likely to be a coincidental
+// run of bytes in the middle of corrupt data.
+var salvageTypes = map[byte]bool{
+	typeString:     true,
+	typeRegExp:     true,
+	typeArray:      true,
+	typeHash:       true,
+	typeHashDef:    true,
+	typeObject:     true,
+	typeStruct:     true,
+	typeUsrMarshal: true,
+	typeUsrDef:     true,
+	typeData:       true,
+}
+
+// A Fragment is a complete value recovered from a corrupt Marshal stream by Salvage.
+type Fragment struct {
+	Span
+	Type string `json:"type"` // Marshal type of the value, e.g "Array" or "String".
+
+	// Findings lists problems within the fragment that didn't prevent it from being read. Links and symlinks usually
+	// refer to objects and symbols that precede the fragment, so they're reported here as bad.
+	Findings []Finding `json:"findings,omitempty"`
+}
+
+// Salvage reads all of r and attempts to recover what it can from a corrupt or truncated Marshal stream. The stream is
+// validated first, then Salvage scans forward from the start of the top level value looking for plausible structure
+// boundaries: positions at which a complete String, Regexp, Array, Hash, object, struct or user type can be read. Each
+// one found is returned as a Fragment, and scanning resumes after it. A stream that is intact yields its top level
+// value as the only Fragment (if it's one of those types).
+// The report describes the stream as a whole, as returned by Validate. Fragments can be copied out of the original data
+// and examined further. They are not standalone Marshal streams: links and symlinks within them are left untouched.
+// Salvage is intended for forensics rather than production use. In the worst case it reads each byte of the stream many
+// times over. The returned error is only non-nil if reading from r failed.
+func Salvage(r io.Reader) (*ValidationReport, []Fragment, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "salvage")
+	}
+
+	br := bytes.NewReader(data)
+	s := scanner{r: bufio.NewReader(br)}
+	if err := s.stream(); err != nil && err != errScanStop {
+		return nil, nil, err
+	}
+	report := s.report
+
+	pos := 0
+	if len(data) >= len(magic) && bytes.Equal(data[:len(magic)], magic) {
+		pos = len(magic)
+	}
+
+	var frags []Fragment
+	for pos < len(data) {
+		br.Reset(data[pos:])
+		s = scanner{r: s.r, base: pos}
+		s.r.Reset(br)
+
+		var sc scalar
+		if err := s.valueOf(&sc, -1, false); err == errScanStop || !salvageTypes[sc.typ] {
+			pos++
+			continue
+		} else if err != nil {
+			return nil, nil, err
+		}
+
+		frags = append(frags, Fragment{Span{pos, s.report.Size}, typeName(sc.typ), s.report.Findings})
+		pos += s.report.Size
+	}
+	return &report, frags, nil
+}
@@ -0,0 +1,39 @@
+package rmarsh_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/samcday/rmarsh"
+)
+
+func TestSalvage(t *testing.T) {
+	raw := []byte{
+		0x04, 0x08,
+		'[', 0x08, // An array of 3 elements,
+		'"', 0x06, 'a', // the string "a",
+		'[', 0x06, 'i', 0x06, // the array [1],
+		0xFF, // and then garbage.
+	}
+
+	report, frags, err := rmarsh.Salvage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Valid() || report.Findings[0].Kind != rmarsh.FindingUnknownType {
+		t.Errorf("Unexpected report %+v", report)
+	}
+
+	exp := []rmarsh.Fragment{
+		{Span: rmarsh.Span{Offset: 4, Len: 3}, Type: "String"},
+		{Span: rmarsh.Span{Offset: 7, Len: 4}, Type: "Array"},
+	}
+	if len(frags) != len(exp) {
+		t.Fatalf("Unexpected fragments %+v", frags)
+	}
+	for i := range exp {
+		if frags[i].Span != exp[i].Span || frags[i].Type != exp[i].Type || len(frags[i].Findings) > 0 {
+			t.Errorf("Fragment %d is %+v, expected %+v", i, frags[i], exp[i])
+		}
+	}
+}
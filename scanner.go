@@ -0,0 +1,691 @@
+package rmarsh
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+// The nesting depth at which the scanner gives up if no lower MaxDepth limit is set. Each level of nesting is a level of
+// recursion, so this stops hostile input from exhausting the stack.
+const scanMaxDepth = 10000
+
+// errScanStop is used internally to unwind the scanner after a fatal finding has been recorded.
+var errScanStop = errors.New("scan stopped")
+
+// scanner is a simple recursive descent walker over the complete Marshal grammar. It doesn't produce tokens like the
+// Parser does, instead it's used to power whole-stream utilities like Validate and NewIndex. Utilities that need the
+// content of the stream too, like readTree and DumpTokens, are built on a scanVisitor.
+type scanner struct {
+	r      *bufio.Reader
+	base   int // Offset of the first byte read from r, within the Marshal stream it belongs to.
+	limits ValidateLimits
+	report ValidationReport
+
+	depth    int
+	classErr error    // set once a class is rejected by the AllowClass limit
+	syms     []string // symbol table, needed to resolve the names of symlinked ivar keys
+	links    int      // number of linkable objects seen so far
+	est      *SizeEstimate
+
+	// The remaining fields are only used when record is set, to capture the information needed to build an Index.
+	record  bool
+	symOffs []int           // offset of each symbol definition, by symbol id
+	objs    []scanObj       // location of each linkable object, by link id
+	path    []string        // path components leading to the current value
+	paths   map[string]Span // location of every value reachable via a path, only collected if non-nil
+	onRef   func(typ byte, id, beg, end int) error
+
+	visit   scanVisitor // told about each element as it's read, if set
+	keep    bool        // keep the content of every value, for visit
+	skim    bool        // skip the content of Strings and Regexps, even if it would be checked for valid UTF-8
+	elems   []*scanElem // elements currently being read, innermost last, only kept if visit is set
+	scratch scanElem    // stands in for the current element if visit isn't set
+}
+
+// A scanElem describes a single element of the stream to a scanVisitor. That includes wrappers, links, and the symbols
+// naming classes and instance variables. Its fields are filled in as the element is read.
+type scanElem struct {
+	off  int    // Offset of the element.
+	typ  byte   // Type of the element.
+	size int    // Number of bytes the element occupies, including any elements nested in it. Set once it's been read.
+	id   int    // Link id of a linkable object or link, or symbol id of a symbol or symlink. -1 if there is neither.
+	len  int    // Declared length of a String, Symbol, Array, Hash, object, Struct, ivar list and so on.
+	num  int    // Value of a Fixnum, options of a Regexp, or sign of a Bignum (1 or -1).
+	data []byte // Contents of a String, Regexp, Float, Bignum, Class, Module or user defined type.
+	sym  string // Name of a symbol or symlink, or of the class or module named by an object or wrapper.
+}
+
+// A scanVisitor is told about each element the scanner reads, in stream order. begin is called as soon as the type of
+// an element is known, and end once all of it has been read, unless the scan stopped first. linked is called in
+// between if the element is assigned a link id. Ruby links a user defined object wrapped in an ivar after reading the
+// ivars, so in that case it's the ivar wrapper that is linked. If begin or end return an error the scan stops.
+type scanVisitor interface {
+	begin(e *scanElem) error
+	linked(e *scanElem)
+	end(e *scanElem) error
+}
+
+// scalar captures the content of a simple value, for callers of valueOf that need more than its structure.
+type scalar struct {
+	typ   byte
+	num   int
+	sym   string
+	str   []byte // Contents of a String or Regexp.
+	ivar  bool   // Set if the value is wrapped in an ivar.
+	class string // Class name of the value, if it names one.
+	len   int    // Declared length of an Array, Hash, object or struct.
+}
+
+// scanObj records the location of a linkable object, and the offset at which it was assigned its link id.
+type scanObj struct {
+	Span
+	reg   int
+	typ   byte
+	class string // Class name of objects, structs, user defined types and instances of user subclasses.
+}
+
+func (s *scanner) off() int {
+	return s.base + s.report.Size
+}
+
+func (s *scanner) find(off int, kind FindingKind, format string, a ...interface{}) {
+	s.report.Findings = append(s.report.Findings, Finding{off, kind, fmt.Sprintf(format, a...)})
+}
+
+// fatal records a finding and then stops the scan.
+func (s *scanner) fatal(off int, kind FindingKind, format string, a ...interface{}) error {
+	s.find(off, kind, format, a...)
+	return errScanStop
+}
+
+// checkDepth fails if the value beginning at off is nested too deeply.
+func (s *scanner) checkDepth(off int) error {
+	max := s.limits.MaxDepth
+	if max <= 0 || max > scanMaxDepth {
+		max = scanMaxDepth
+	}
+	if s.depth > max {
+		return s.fatal(off, FindingLimitExceeded, "nesting depth exceeds %d", max)
+	}
+	return nil
+}
+
+// enter begins a new element of the given type at off, and returns the scanElem to fill in as it's read.
+func (s *scanner) enter(off int, typ byte) (*scanElem, error) {
+	if s.visit == nil {
+		return &s.scratch, nil
+	}
+	e := &scanElem{off: off, typ: typ, id: -1}
+	s.elems = append(s.elems, e)
+	return e, s.visit.begin(e)
+}
+
+// cur returns the element currently being read.
+func (s *scanner) cur() *scanElem {
+	if len(s.elems) == 0 {
+		return &s.scratch
+	}
+	return s.elems[len(s.elems)-1]
+}
+
+// leave completes the element currently being read.
+func (s *scanner) leave() error {
+	if s.visit == nil {
+		return nil
+	}
+	e := s.elems[len(s.elems)-1]
+	s.elems = s.elems[:len(s.elems)-1]
+	e.size = s.off() - e.off
+	return s.visit.end(e)
+}
+
+func (s *scanner) byte() (byte, error) {
+	if s.limits.MaxSize > 0 && s.report.Size >= s.limits.MaxSize {
+		return 0, s.fatal(s.off(), FindingLimitExceeded, "stream exceeds %d bytes", s.limits.MaxSize)
+	}
+	c, err := s.r.ReadByte()
+	if err == io.EOF {
+		return 0, s.fatal(s.off(), FindingTruncated, "unexpected end of stream")
+	} else if err != nil {
+		return 0, err
+	}
+	s.report.Size++
+	return c, nil
+}
+
+// bytes reads n bytes from the stream. If keep is false the bytes are discarded instead.
+func (s *scanner) bytes(n int, keep bool) ([]byte, error) {
+	if s.limits.MaxSize > 0 && s.report.Size+n > s.limits.MaxSize {
+		return nil, s.fatal(s.off(), FindingLimitExceeded, "stream exceeds %d bytes", s.limits.MaxSize)
+	}
+
+	var b []byte
+	var rd int
+	var err error
+	if keep {
+		// We let the buffer grow as data arrives, rather than trusting the declared length up front.
+		var buf bytes.Buffer
+		var rd64 int64
+		rd64, err = io.CopyN(&buf, s.r, int64(n))
+		rd, b = int(rd64), buf.Bytes()
+	} else {
+		rd, err = s.r.Discard(n)
+	}
+	s.report.Size += rd
+
+	if err == io.EOF {
+		return nil, s.fatal(s.off(), FindingTruncated, "unexpected end of stream, %d of %d bytes read", rd, n)
+	} else if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (s *scanner) long() (int, error) {
+	var b [fixnumMaxBytes]byte
+	var err error
+	if b[0], err = s.byte(); err != nil {
+		return 0, err
+	}
+	// The first byte tells us how many more there are.
+	_, sz := getLong(b[:1])
+	for i := 1; i < sz; i++ {
+		if b[i], err = s.byte(); err != nil {
+			return 0, err
+		}
+	}
+	n, _ := getLong(b[:sz])
+	return int(n), nil
+}
+
+// length reads a long that declares the size of something, making sure it's sane.
+func (s *scanner) length(what string) (int, error) {
+	off := s.off()
+	n, err := s.long()
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 {
+		return 0, s.fatal(off, FindingBadLength, "negative %s length %d", what, n)
+	}
+	if s.limits.MaxLength > 0 && n > s.limits.MaxLength {
+		return 0, s.fatal(off, FindingLimitExceeded, "%s length %d exceeds limit of %d", what, n, s.limits.MaxLength)
+	}
+	if s.est != nil {
+		s.est.add(what, n)
+	}
+	return n, nil
+}
+
+// blob reads a length prefixed sequence of bytes.
+func (s *scanner) blob(what string, keep bool) ([]byte, error) {
+	n, err := s.length(what)
+	if err != nil {
+		return nil, err
+	}
+	s.cur().len = n
+	return s.bytes(n, keep)
+}
+
+// link registers a new linkable object of the given type that begins at the given offset.
+func (s *scanner) link(off int, typ byte) error {
+	if s.limits.MaxLinks > 0 && s.links >= s.limits.MaxLinks {
+		return s.fatal(off, FindingLimitExceeded, "stream exceeds %d linkable objects", s.limits.MaxLinks)
+	}
+	s.links++
+	if s.record {
+		s.objs = append(s.objs, scanObj{Span: Span{off, 0}, reg: s.off(), typ: typ})
+	}
+	if s.visit != nil {
+		e := s.cur()
+		e.id = s.links - 1
+		s.visit.linked(e)
+	}
+	return nil
+}
+
+// checkClass fails with a fatal finding if the named class or module is not permitted by the AllowClass limit.
+func (s *scanner) checkClass(off int, name string) error {
+	if s.limits.AllowClass != nil && !s.limits.AllowClass(name) {
+		s.classErr = ClassError{name, off}
+		return s.fatal(off, FindingDisallowedClass, "class %s is not allowed", name)
+	}
+	return nil
+}
+
+// ref handles a link or symlink to a previously seen object or symbol.
+func (s *scanner) ref(typ byte, id, beg int) error {
+	if s.onRef != nil {
+		return s.onRef(typ, id, beg, s.off())
+	}
+	return nil
+}
+
+func (s *scanner) stream() error {
+	if err := s.header(); err != nil {
+		return err
+	}
+	return s.value()
+}
+
+// header reads the magic header at the start of a stream.
+func (s *scanner) header() error {
+	c1, err := s.byte()
+	if err != nil {
+		return err
+	}
+	c2, err := s.byte()
+	if err != nil {
+		return err
+	}
+	if c1 != magic[0] || c2 != magic[1] {
+		return s.fatal(0, FindingBadMagic, "expected magic header 0x0408, got 0x%.2X%.2X", c1, c2)
+	}
+	return nil
+}
+
+// symbol reads a symbol or symlink, returning the symbol name.
+func (s *scanner) symbol() (string, error) {
+	off := s.off()
+	typ, err := s.byte()
+	if err != nil {
+		return "", err
+	}
+	if typ != typeSymbol && typ != typeSymlink && typ != typeIvar {
+		return "", s.fatal(off, FindingNonSymbol, "expected symbol, got type 0x%.2X", typ)
+	}
+	if _, err = s.enter(off, typ); err != nil {
+		return "", err
+	}
+	sym, err := s.symbolBody(off, typ)
+	if err == nil {
+		err = s.leave()
+	}
+	return sym, err
+}
+
+// symbolBody reads the rest of a symbol, symlink or ivar wrapped symbol that begins at off.
+func (s *scanner) symbolBody(off int, typ byte) (string, error) {
+	e := s.cur()
+	switch typ {
+	case typeSymbol:
+		b, err := s.blob("symbol", true)
+		if err != nil {
+			return "", err
+		}
+		if s.limits.MaxSymbols > 0 && len(s.syms) >= s.limits.MaxSymbols {
+			return "", s.fatal(off, FindingLimitExceeded, "stream exceeds %d symbols", s.limits.MaxSymbols)
+		}
+		e.id, e.sym = len(s.syms), string(b)
+		s.syms = append(s.syms, e.sym)
+		if s.record {
+			s.symOffs = append(s.symOffs, off)
+		}
+		return e.sym, nil
+	case typeSymlink:
+		id, err := s.long()
+		if err != nil {
+			return "", err
+		}
+		e.id = id
+		if id < 0 || id >= len(s.syms) {
+			s.find(off, FindingBadSymlink, "symlink id %d out of range, %d symbols seen", id, len(s.syms))
+			return "", s.ref(typ, id, off)
+		}
+		e.sym = s.syms[id]
+		return e.sym, s.ref(typ, id, off)
+	}
+	// Symbols with a non-ASCII encoding are wrapped in an ivar carrying the encoding.
+	sym, err := s.symbol()
+	if err != nil {
+		return "", err
+	}
+	e.sym = sym
+	return sym, s.ivars(nil)
+}
+
+// pairs reads n symbol => value pairs, as found in objects and structs.
+func (s *scanner) pairs(n int) error {
+	for i := 0; i < n; i++ {
+		sym, err := s.symbol()
+		if err != nil {
+			return err
+		}
+		if s.paths != nil {
+			s.path = append(s.path, "."+sym)
+		}
+		if err = s.value(); err != nil {
+			return err
+		}
+		if s.paths != nil {
+			s.path = s.path[:len(s.path)-1]
+		}
+	}
+	return nil
+}
+
+// key reads a hash key, returning the path component for its value.
+func (s *scanner) key(i int) (string, error) {
+	var sc scalar
+	if err := s.valueOf(&sc, -1, false); err != nil {
+		return "", err
+	}
+
+	switch sc.typ {
+	case typeSymbol:
+		return "[:" + sc.sym + "]", nil
+	case typeString:
+		return "[" + strconv.Quote(string(sc.str)) + "]", nil
+	case typeFixnum:
+		return "[" + strconv.Itoa(sc.num) + "]", nil
+	}
+	return "[#" + strconv.Itoa(i) + "]", nil
+}
+
+// ivars reads the instance variable list that follows an ivar-wrapped value. If sc is not nil, it describes the wrapped
+// value, and its content will be checked for valid UTF-8 if the ivars claim that encoding.
+func (s *scanner) ivars(sc *scalar) error {
+	n, err := s.length("ivar")
+	if err != nil {
+		return err
+	}
+	s.cur().len = n
+	for i := 0; i < n; i++ {
+		key, err := s.symbol()
+		if err != nil {
+			return err
+		}
+		off := s.off()
+		var val scalar
+		if err := s.valueOf(&val, -1, false); err != nil {
+			return err
+		}
+		if key == "E" && val.typ == typeTrue && sc != nil && (sc.typ == typeString || sc.typ == typeRegExp) && !utf8.Valid(sc.str) {
+			s.find(off, FindingInvalidUTF8, "string marked as UTF-8 contains invalid sequences")
+		}
+	}
+	return nil
+}
+
+// value reads a complete value from the stream.
+func (s *scanner) value() error {
+	return s.valueOf(nil, -1, true)
+}
+
+// valueOf reads a complete value. If sc is not nil, it's populated with a description of the value. Wrapper types like
+// ivars pass sc down to the value they wrap.
+// If this value is wrapped by an ivar, extended or user class marker, wrap is the offset of the wrapper. Otherwise it's
+// -1. The location of the value is recorded in the path index if index is true.
+func (s *scanner) valueOf(sc *scalar, wrap int, index bool) (err error) {
+	off := s.off()
+	var typ byte
+	if typ, err = s.byte(); err != nil {
+		return
+	}
+	if sc != nil {
+		sc.typ = typ
+	}
+
+	s.depth++
+	defer func() { s.depth-- }()
+	if err = s.checkDepth(off); err != nil {
+		return
+	}
+	var e *scanElem
+	if e, err = s.enter(off, typ); err != nil {
+		return
+	}
+	keep := s.keep
+	if s.est != nil && typ != typeIvar && typ != typeExtended && typ != typeUClass {
+		s.est.Values++
+	}
+
+	// Objects wrapped in ivars etc. are considered to begin at the wrapper.
+	beg := off
+	if wrap >= 0 {
+		beg = wrap
+	}
+	lnk := len(s.objs)
+	var class string
+
+	switch typ {
+	case typeNil, typeTrue, typeFalse:
+
+	case typeFixnum:
+		if e.num, err = s.long(); err == nil && sc != nil {
+			sc.num = e.num
+		}
+
+	case typeSymbol, typeSymlink:
+		var sym string
+		if sym, err = s.symbolBody(off, typ); err == nil && sc != nil {
+			sc.typ, sc.sym = typeSymbol, sym
+		}
+
+	case typeLink:
+		if e.id, err = s.long(); err != nil {
+			return
+		}
+		if e.id < 0 || e.id >= s.links {
+			s.find(off, FindingBadLink, "link id %d out of range, %d objects seen", e.id, s.links)
+		}
+		err = s.ref(typ, e.id, off)
+
+	case typeBignum:
+		if err = s.link(beg, typ); err != nil {
+			return
+		}
+		var sign byte
+		if sign, err = s.byte(); err != nil {
+			return
+		}
+		if e.num = 1; sign == '-' {
+			e.num = -1
+		} else if sign != '+' {
+			return s.fatal(off+1, FindingBadLength, "invalid bignum sign 0x%.2X", sign)
+		}
+		var n int
+		if n, err = s.length("bignum"); err == nil {
+			e.data, err = s.bytes(n*2, keep)
+		}
+
+	case typeFloat:
+		if err = s.link(beg, typ); err != nil {
+			return
+		}
+		e.data, err = s.blob("float", keep)
+
+	case typeClass, typeModule, typeModuleOld:
+		if err = s.link(beg, typ); err != nil {
+			return
+		}
+		if e.data, err = s.blob("class/module", keep || s.limits.AllowClass != nil); err == nil {
+			err = s.checkClass(off, string(e.data))
+		}
+
+	case typeString:
+		if err = s.link(beg, typ); err != nil {
+			return
+		}
+		if e.data, err = s.blob("string", keep || sc != nil && !s.skim); err == nil && sc != nil {
+			sc.str = e.data
+		}
+
+	case typeRegExp:
+		if err = s.link(beg, typ); err != nil {
+			return
+		}
+		if e.data, err = s.blob("regexp", keep || sc != nil && !s.skim); err != nil {
+			return
+		}
+		if sc != nil {
+			sc.str = e.data
+		}
+		var opts byte
+		opts, err = s.byte()
+		e.num = int(opts)
+
+	case typeArray:
+		if err = s.link(beg, typ); err != nil {
+			return
+		}
+		var n int
+		if n, err = s.length("array"); err != nil {
+			return
+		}
+		e.len = n
+		if sc != nil {
+			sc.len = n
+		}
+		for i := 0; i < n && err == nil; i++ {
+			if s.paths != nil {
+				s.path = append(s.path, "["+strconv.Itoa(i)+"]")
+			}
+			err = s.value()
+			if s.paths != nil {
+				s.path = s.path[:len(s.path)-1]
+			}
+		}
+
+	case typeHash, typeHashDef:
+		if err = s.link(beg, typ); err != nil {
+			return
+		}
+		var n int
+		if n, err = s.length("hash"); err != nil {
+			return
+		}
+		e.len = n
+		if sc != nil {
+			sc.len = n
+		}
+		for i := 0; i < n && err == nil; i++ {
+			if s.paths == nil {
+				if err = s.value(); err == nil {
+					err = s.value()
+				}
+				continue
+			}
+
+			var k string
+			if k, err = s.key(i); err != nil {
+				return
+			}
+			s.path = append(s.path, k)
+			err = s.value()
+			s.path = s.path[:len(s.path)-1]
+		}
+		if err == nil && typ == typeHashDef {
+			err = s.valueOf(nil, -1, false)
+		}
+
+	case typeIvar:
+		if sc == nil {
+			sc = new(scalar)
+		}
+		sc.ivar = true
+		if err = s.valueOf(sc, beg, false); err == nil {
+			err = s.ivars(sc)
+		}
+		if err == nil && sc.typ == typeUsrDef {
+			err = s.link(beg, typeUsrDef)
+		}
+
+	case typeObject, typeStruct:
+		if err = s.link(beg, typ); err != nil {
+			return
+		}
+		if class, err = s.symbol(); err != nil {
+			return
+		}
+		e.sym = class
+		if err = s.checkClass(off, class); err != nil {
+			return
+		}
+		if e.len, err = s.length("object"); err != nil {
+			return
+		}
+		if sc != nil {
+			sc.len = e.len
+		}
+		err = s.pairs(e.len)
+
+	case typeUsrMarshal, typeData:
+		if err = s.link(beg, typ); err != nil {
+			return
+		}
+		if class, err = s.symbol(); err != nil {
+			return
+		}
+		e.sym = class
+		if err = s.checkClass(off, class); err == nil {
+			err = s.valueOf(nil, -1, false)
+		}
+
+	case typeUsrDef:
+		// Ruby reads the ivars of a user defined object's data before it constructs the object, so anything linkable in
+		// those ivars is assigned a link id first. The enclosing ivar registers the object in that case.
+		if sc == nil || !sc.ivar {
+			if err = s.link(beg, typ); err != nil {
+				return
+			}
+		}
+		if class, err = s.symbol(); err != nil {
+			return
+		}
+		e.sym = class
+		if err = s.checkClass(off, class); err == nil {
+			e.data, err = s.blob("user defined data", keep)
+		}
+
+	case typeExtended, typeUClass:
+		if sc == nil {
+			sc = new(scalar)
+		}
+		var sym string
+		if sym, err = s.symbol(); err != nil {
+			return
+		}
+		e.sym = sym
+		if err = s.checkClass(off, sym); err != nil {
+			return
+		}
+		err = s.valueOf(sc, beg, false)
+		if typ == typeUClass {
+			sc.class = sym
+		}
+
+	default:
+		return s.fatal(off, FindingUnknownType, "unknown type 0x%.2X", typ)
+	}
+
+	if sc != nil {
+		if class != "" {
+			sc.class = class
+		}
+		class = sc.class
+	}
+	if err == nil && wrap < 0 {
+		for i := lnk; i < len(s.objs); i++ {
+			if s.objs[i].Offset == beg {
+				s.objs[i].Len = s.off() - beg
+				s.objs[i].class = class
+				break
+			}
+		}
+		if index && s.paths != nil {
+			s.paths[strings.Join(s.path, "")] = Span{beg, s.off() - beg}
+		}
+	}
+	if err == nil {
+		err = s.leave()
+	}
+	return
+}
@@ -0,0 +1,44 @@
+package rmarsh
+
+import "time"
+
+// Stats summarises a single Marshal stream read by a Parser or written by a Generator. It's intended to be fed into
+// whatever logging or metrics system a service uses, so Marshal handling can be monitored without instrumenting every
+// call site.
+type Stats struct {
+	Bytes    int           // Size of the stream, including the magic header. Measured before compression and framing.
+	Tokens   int           // Number of tokens read by a Parser, or values written by a Generator.
+	Duration time.Duration // Time from the first token read (or value written) until the stream was complete.
+	Err      error         // The error that ended the stream early, if any. Exceeded limits are reported as a LimitError.
+}
+
+// A StatsHook is called once for every Marshal stream a Parser or Generator finishes with, whether successfully or not.
+type StatsHook func(Stats)
+
+// statsTracker accumulates Stats for the stream currently being processed.
+type statsTracker struct {
+	hook   StatsHook
+	start  time.Time
+	tokens int
+	done   bool
+}
+
+func (t *statsTracker) reset() {
+	t.start = time.Time{}
+	t.tokens = 0
+	t.done = false
+}
+
+func (t *statsTracker) begin() {
+	if t.start.IsZero() {
+		t.start = time.Now()
+	}
+}
+
+func (t *statsTracker) finish(bytes int, err error) {
+	if t.done {
+		return
+	}
+	t.done = true
+	t.hook(Stats{Bytes: bytes, Tokens: t.tokens, Duration: time.Since(t.start), Err: err})
+}
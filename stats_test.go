@@ -0,0 +1,71 @@
+package rmarsh_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/samcday/rmarsh"
+)
+
+func TestParserStatsHook(t *testing.T) {
+	var stats []rmarsh.Stats
+	p := rmarsh.NewParser(bytes.NewReader([]byte{0x04, 0x08, ':', 0x06, 'a'}))
+	p.SetStatsHook(func(s rmarsh.Stats) { stats = append(stats, s) })
+
+	expectToken(t, p, rmarsh.TokenSymbol)
+	expectToken(t, p, rmarsh.TokenEOF)
+	expectToken(t, p, rmarsh.TokenEOF)
+
+	if len(stats) != 1 {
+		t.Fatalf("Hook called %d times", len(stats))
+	}
+	if s := stats[0]; s.Bytes != 5 || s.Tokens != 1 || s.Err != nil {
+		t.Errorf("Unexpected stats %+v", s)
+	}
+
+	p.Reset(bytes.NewReader([]byte{0x04, 0x08, ':', 0x06}))
+	if _, _, _, err := p.Read(); err == nil {
+		t.Fatal("Expected error")
+	}
+	if len(stats) != 2 || stats[1].Err == nil {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+}
+
+func TestGenStatsHook(t *testing.T) {
+	var stats []rmarsh.Stats
+	gen := rmarsh.NewGenerator(ioutil.Discard)
+	gen.SetStatsHook(func(s rmarsh.Stats) { stats = append(stats, s) })
+
+	if err := gen.StartArray(2); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := gen.Fixnum(int64(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := gen.EndArray(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(stats) != 1 {
+		t.Fatalf("Hook called %d times", len(stats))
+	}
+	if s := stats[0]; s.Bytes != 8 || s.Tokens != 3 || s.Err != nil {
+		t.Errorf("Unexpected stats %+v", s)
+	}
+
+	gen.Reset(nil)
+	gen.SetMaxOutputBytes(4)
+	if err := gen.String("hello"); err == nil {
+		t.Fatal("Expected error")
+	}
+	if len(stats) != 2 {
+		t.Fatalf("Hook called %d times", len(stats))
+	}
+	if _, ok := stats[1].Err.(rmarsh.LimitError); !ok {
+		t.Errorf("Unexpected stats %+v", stats[1])
+	}
+}
@@ -0,0 +1,29 @@
+package rmarsh
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// ErrInvalidSymbol is the error returned when a Generator is asked to write a symbol that fails IsValidSymbol.
+var ErrInvalidSymbol = fmt.Errorf("Invalid Symbol")
+
+// IsValidSymbol reports whether sym is a usable name for a Ruby Symbol: it must not be empty, must be valid UTF-8 and
+// must not contain NUL bytes, which can't appear in the name of a method, constant or instance variable. Ruby will dump
+// and load Symbols that break these rules without complaint though, so a Generator only rejects them if asked to, with
+// SetSymbolValidation.
+func IsValidSymbol(sym string) bool {
+	return sym != "" && utf8.ValidString(sym) && strings.IndexByte(sym, 0) < 0
+}
+
+// symUTF8 reports whether sym needs to be marked as UTF-8 when it's written. Ruby loads a Symbol without an encoding
+// as US-ASCII if it can, and as binary otherwise, so only names containing non-ASCII characters need the marker.
+func symUTF8(sym string) bool {
+	for i := 0; i < len(sym); i++ {
+		if sym[i] >= utf8.RuneSelf {
+			return utf8.ValidString(sym)
+		}
+	}
+	return false
+}
@@ -0,0 +1,220 @@
+package rmarsh
+
+import (
+	"encoding/binary"
+	"io"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Time writes t to the Marshal stream as a Ruby Time, in the layout Ruby's Time#_dump produces. The date and time of
+// day are always stored in UTC, so the UTC offset of t is written alongside them in the offset instance variable, and
+// the name of its zone in the zone instance variable. This ensures the Time Ruby loads is in the same zone as t, rather
+// than silently shifted into the local zone of the Ruby process. Nanoseconds that don't fit in the microsecond
+// resolution of the stored time are written to the nano_num, nano_den and submicro instance variables.
+// The layout only has room for years from 1900 to 67435. Ruby stores the year of any other Time in an extra year
+// instance variable, which Time doesn't write, so it returns an error for those. ReadTime reads the Time back.
+func (gen *Generator) Time(t time.Time) error {
+	utc := t.Location() == time.UTC
+	zone, off := t.Zone()
+	u := t.UTC()
+	if u.Year() < 1900 || u.Year() > 1900+0xffff {
+		return errors.Errorf("Time year %d out of range", u.Year())
+	}
+
+	var p, s uint32 = 1 << 31, 0
+	if utc {
+		p |= 1 << 30
+	}
+	p |= uint32(u.Year()-1900)<<14 | uint32(u.Month()-1)<<10 | uint32(u.Day())<<5 | uint32(u.Hour())
+	s = uint32(u.Minute())<<26 | uint32(u.Second())<<20 | uint32(u.Nanosecond()/1000)
+	var data [8]byte
+	binary.LittleEndian.PutUint32(data[:4], p)
+	binary.LittleEndian.PutUint32(data[4:], s)
+
+	nano := u.Nanosecond() % 1000
+	n := 0
+	if nano != 0 {
+		n += 3
+	}
+	if !utc {
+		n++
+	}
+	if zone != "" {
+		n++
+	}
+
+	if n > 0 {
+		if err := gen.StartIVar(n); err != nil {
+			return err
+		}
+	}
+	if err := gen.UserDefinedObject("Time", string(data[:])); err != nil {
+		return err
+	}
+	if n == 0 {
+		return nil
+	}
+
+	if nano != 0 {
+		if err := gen.Symbol("nano_num"); err != nil {
+			return err
+		}
+		if err := gen.Fixnum(int64(nano)); err != nil {
+			return err
+		}
+		if err := gen.Symbol("nano_den"); err != nil {
+			return err
+		}
+		if err := gen.Fixnum(1); err != nil {
+			return err
+		}
+
+		// Ruby 1.9.1 only understands the nanoseconds as packed decimal digits.
+		submicro := []byte{byte(nano/100)<<4 | byte(nano/10%10), byte(nano%10) << 4}
+		if submicro[1] == 0 {
+			submicro = submicro[:1]
+		}
+		if err := gen.Symbol("submicro"); err != nil {
+			return err
+		}
+		if err := gen.StringBytes(submicro); err != nil {
+			return err
+		}
+	}
+	if !utc {
+		if err := gen.Symbol("offset"); err != nil {
+			return err
+		}
+		if err := gen.Fixnum(int64(off)); err != nil {
+			return err
+		}
+	}
+	if zone != "" {
+		if err := gen.Symbol("zone"); err != nil {
+			return err
+		}
+		if err := gen.asciiString(zone); err != nil {
+			return err
+		}
+	}
+	return gen.EndIVar()
+}
+
+// asciiString writes a String with US-ASCII encoding, as Ruby uses for the names of time zones.
+func (gen *Generator) asciiString(s string) error {
+	if err := gen.StartIVar(1); err != nil {
+		return err
+	}
+	if err := gen.String(s); err != nil {
+		return err
+	}
+	if err := gen.Symbol("E"); err != nil {
+		return err
+	}
+	if err := gen.Bool(false); err != nil {
+		return err
+	}
+	return gen.EndIVar()
+}
+
+// ReadTime reads a complete Marshal stream from r containing a Ruby Time, as written by Generator.Time or by any version
+// of Ruby since 1.8. A Time Ruby would load as UTC is returned in UTC, one with a UTC offset is returned in a fixed zone
+// with that offset and the stored zone name, and one with neither (as older versions of Ruby write) in the local zone.
+// Nanoseconds are restored from the nano_num and nano_den instance variables, or the submicro digits Ruby 1.9.1 wrote.
+// A Time with an extended year instance variable is not supported.
+// Reads from r are buffered, so bytes past the end of the Marshal stream may be consumed.
+func ReadTime(r io.Reader) (time.Time, error) {
+	n, err := readTree(r)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if n.typ != typeUsrDef || n.class != "Time" {
+		return time.Time{}, errors.Errorf("Marshal stream holds a %s, not a Time", typeName(n.typ))
+	}
+	if len(n.data) != 8 {
+		return time.Time{}, errors.Errorf("invalid Time data length %d", len(n.data))
+	}
+	p := binary.LittleEndian.Uint32(n.data[:4])
+	s := binary.LittleEndian.Uint32(n.data[4:])
+
+	// Very old versions of Ruby simply wrote the seconds and microseconds since the epoch.
+	if p&(1<<31) == 0 {
+		return time.Unix(int64(p), int64(s)*1000).In(time.Local), nil
+	}
+
+	year := int(p>>14&0xffff) + 1900
+	mon, day, hour := time.Month(p>>10&0xf+1), int(p>>5&0x1f), int(p&0x1f)
+	min, sec, usec := int(s>>26&0x3f), int(s>>20&0x3f), int(s&0xfffff)
+	if mon > time.December || day < 1 || hour > 23 || min > 59 || sec > 60 || usec > 999999 {
+		return time.Time{}, errors.Errorf("invalid Time data %x", n.data)
+	}
+
+	var (
+		nsec, nanoNum, nanoDen, off int
+		zone, submicro              []byte
+		hasNano, hasOff             bool
+	)
+	for _, v := range n.vars {
+		val := v.val
+		if val.typ == typeLink {
+			val = val.ref
+		}
+		switch v.name {
+		case "nano_num":
+			nanoNum, err = timeVarInt(v.name, val)
+			hasNano = true
+		case "nano_den":
+			nanoDen, err = timeVarInt(v.name, val)
+		case "offset":
+			off, err = timeVarInt(v.name, val)
+			hasOff = true
+		case "zone":
+			zone = val.data
+		case "submicro":
+			submicro = val.data
+		case "year":
+			err = errors.New("Time with an extended year is not supported")
+		}
+		if err != nil {
+			return time.Time{}, err
+		}
+	}
+
+	if hasNano {
+		if nanoDen <= 0 || nanoNum < 0 || nanoNum/nanoDen > 999 {
+			return time.Time{}, errors.Errorf("invalid Time nanoseconds %d/%d", nanoNum, nanoDen)
+		}
+		nsec = nanoNum / nanoDen
+	} else if len(submicro) > 0 {
+		digits := []byte{submicro[0] >> 4, submicro[0] & 0xf, 0}
+		if len(submicro) > 1 {
+			digits[2] = submicro[1] >> 4
+		}
+		for _, d := range digits {
+			if d > 9 {
+				return time.Time{}, errors.Errorf("invalid Time submicro digits %x", submicro)
+			}
+			nsec = nsec*10 + int(d)
+		}
+	}
+
+	t := time.Date(year, mon, day, hour, min, sec, usec*1000+nsec, time.UTC)
+	switch {
+	case p&(1<<30) != 0:
+		return t, nil
+	case hasOff:
+		return t.In(time.FixedZone(string(zone), off)), nil
+	default:
+		return t.In(time.Local), nil
+	}
+}
+
+// timeVarInt returns the value of an Integer instance variable of a Time.
+func timeVarInt(name string, n *node) (int, error) {
+	if n.typ != typeFixnum {
+		return 0, errors.Errorf("Time %s is a %s, not a Fixnum", name, typeName(n.typ))
+	}
+	return n.num, nil
+}
@@ -0,0 +1,90 @@
+package rmarsh_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/samcday/rmarsh"
+)
+
+// The testdata/time_* fixtures hold 2017-01-02 03:04:05.123456789 +0100 in the layouts written by different versions
+// of Ruby. Ruby 1.8 only stored microseconds, 1.9.1 added the submicro digits, 1.9.2 the offset and nano_num/nano_den,
+// and 2.0 the zone.
+func TestReadTimeFixtures(t *testing.T) {
+	exp := time.Date(2017, 1, 2, 3, 4, 5, 123456789, time.FixedZone("CET", 3600))
+	for _, fixture := range []struct {
+		name string
+		exp  time.Time
+		zone string
+		off  int
+	}{
+		{"time_ruby18", exp.Truncate(time.Microsecond).Local(), "", 0},
+		{"time_ruby191", exp.Local(), "", 0},
+		{"time_ruby19", exp, "", 3600},
+		{"time_ruby2", exp, "CET", 3600},
+	} {
+		raw, err := ioutil.ReadFile(fixturePath(fixture.name, ".marshal"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		tm, err := rmarsh.ReadTime(bytes.NewReader(raw))
+		if err != nil {
+			t.Fatalf("Fixture %s: %s", fixture.name, err)
+		}
+		if !tm.Equal(fixture.exp) {
+			t.Errorf("Fixture %s: read %s, expected %s", fixture.name, tm, fixture.exp)
+		}
+		if fixture.off == 0 {
+			if tm.Location() != time.Local {
+				t.Errorf("Fixture %s: read time in %s, expected local time", fixture.name, tm.Location())
+			}
+		} else if zone, off := tm.Zone(); zone != fixture.zone || off != fixture.off {
+			t.Errorf("Fixture %s: read zone %q %d, expected %q %d", fixture.name, zone, off, fixture.zone, fixture.off)
+		}
+	}
+}
+
+func TestReadTimeRoundTrip(t *testing.T) {
+	for _, exp := range []time.Time{
+		time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC),
+		time.Date(2017, 1, 2, 3, 4, 5, 6, time.UTC),
+		time.Date(2017, 1, 2, 3, 4, 5, 123456789, time.FixedZone("CET", 3600)),
+		time.Date(1900, 1, 1, 0, 0, 0, 0, time.FixedZone("", -3600*8)),
+		time.Date(67435, 12, 31, 23, 59, 59, 999999999, time.UTC),
+	} {
+		raw := genStream(t, func(gen *rmarsh.Generator) error {
+			return gen.Time(exp)
+		})
+		tm, err := rmarsh.ReadTime(bytes.NewReader(raw))
+		if err != nil {
+			t.Fatalf("ReadTime(%s): %s", exp, err)
+		}
+		if !tm.Equal(exp) {
+			t.Errorf("Read %s, expected %s", tm, exp)
+		}
+		expZone, expOff := exp.Zone()
+		if zone, off := tm.Zone(); zone != expZone || off != expOff {
+			t.Errorf("Read zone %q %d, expected %q %d", zone, off, expZone, expOff)
+		}
+	}
+}
+
+func TestReadTimeInvalid(t *testing.T) {
+	// A String, not a Time.
+	if _, err := rmarsh.ReadTime(bytes.NewReader([]byte{0x04, 0x08, '"', 0x06, 'x'})); err == nil {
+		t.Error("Expected error for String")
+	}
+
+	raw, err := ioutil.ReadFile(fixturePath("time_ruby18", ".marshal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The same Time with an extended year.
+	year := append([]byte{0x04, 0x08, 'I'}, raw[2:]...)
+	year = append(year, 0x06, ':', 0x09, 'y', 'e', 'a', 'r', 'i', 0x02, 0xd0, 0x07)
+	if _, err := rmarsh.ReadTime(bytes.NewReader(year)); err == nil {
+		t.Error("Expected error for extended year")
+	}
+}
@@ -0,0 +1,157 @@
+package rmarsh
+
+import (
+	"bufio"
+	"io"
+	"math/big"
+
+	"github.com/pkg/errors"
+)
+
+// A node is a single value read from a Marshal stream into a generic tree. The Parser and scanner deliberately avoid
+// holding on to values, but some tools (such as WriteRuby) need the whole thing.
+type node struct {
+	typ   byte      // Type of the value. Ivar, extended and user class wrappers are folded into the value they wrap.
+	class string    // Class of objects, structs, user types and user subclasses, or the name of a Class/Module.
+	data  []byte    // Contents of Strings, Regexps, Symbols, Floats, Bignums and user defined types.
+	num   int       // Value of a Fixnum, options of a Regexp, or sign of a Bignum (1 or -1).
+	elems []*node   // Elements of an Array, keys and values of a Hash (interleaved), or the data of a user type.
+	def   *node     // Default value of a Hash.
+	vars  []nodeVar // Instance variables of a value, or members of a Struct.
+	exts  []string  // Modules the value was extended with, outermost first.
+	ref   *node     // The object a link refers to.
+}
+
+type nodeVar struct {
+	name string
+	val  *node
+}
+
+// A treeReader builds trees of nodes from the elements read by a scanner, so problems with the stream are reported as
+// findings.
+type treeReader struct {
+	frames []treeFrame // values currently being read, innermost last
+	objs   []*node     // linkable objects by link id
+}
+
+// A treeFrame collects the nodes of the elements nested in a value.
+type treeFrame struct {
+	n    *node // nil for ivar, extended and user class wrappers, until the value they wrap has been read
+	kids []*node
+}
+
+// readTree reads a complete Marshal stream from r into a tree. Reads from r are buffered.
+func readTree(r io.Reader) (*node, error) {
+	t := treeReader{frames: []treeFrame{{}}}
+	s := scanner{r: bufio.NewReader(r), visit: &t, keep: true}
+	if err := s.stream(); err != nil && err != errScanStop {
+		return nil, err
+	}
+	if !s.report.Valid() {
+		return nil, errors.Errorf("invalid Marshal stream: %s", s.report.Findings[0])
+	}
+	return t.frames[0].kids[0], nil
+}
+
+func (t *treeReader) begin(e *scanElem) error {
+	var n *node
+	switch e.typ {
+	case typeIvar, typeExtended, typeUClass:
+	case typeSymlink:
+		n = &node{typ: typeSymbol}
+	default:
+		n = &node{typ: e.typ}
+	}
+	t.frames = append(t.frames, treeFrame{n: n})
+	return nil
+}
+
+func (t *treeReader) linked(e *scanElem) {
+	f := &t.frames[len(t.frames)-1]
+	if f.n == nil {
+		// A user defined object wrapped in an ivar is linked once the ivars have been read.
+		f.n = f.kids[0]
+	}
+	t.objs = append(t.objs, f.n)
+}
+
+// end completes the node of an element, once all of it has been read, and adds it to the value it's nested in.
+// Wrappers are folded into the value they wrap.
+func (t *treeReader) end(e *scanElem) error {
+	f := t.frames[len(t.frames)-1]
+	t.frames = t.frames[:len(t.frames)-1]
+
+	n := f.n
+	switch e.typ {
+	case typeFixnum:
+		n.num = e.num
+
+	case typeSymbol, typeSymlink:
+		n.data = []byte(e.sym)
+
+	case typeLink:
+		// The scanner only records a finding for a bad link, which readTree will report.
+		if e.id >= 0 && e.id < len(t.objs) {
+			n.ref = t.objs[e.id]
+		}
+
+	case typeBignum, typeFloat, typeString, typeRegExp:
+		n.data, n.num = e.data, e.num
+
+	case typeClass, typeModule, typeModuleOld:
+		n.class = string(e.data)
+
+	case typeArray, typeHash:
+		n.elems = f.kids
+
+	case typeHashDef:
+		n.elems, n.def = f.kids[:len(f.kids)-1], f.kids[len(f.kids)-1]
+
+	case typeObject, typeStruct:
+		n.class, n.vars = e.sym, nodeVars(f.kids[1:])
+
+	case typeUsrMarshal, typeData:
+		n.class, n.elems = e.sym, f.kids[1:]
+
+	case typeUsrDef:
+		n.class, n.data = e.sym, e.data
+
+	case typeIvar:
+		n = f.kids[0]
+		n.vars = append(n.vars, nodeVars(f.kids[1:])...)
+
+	case typeExtended:
+		n = f.kids[1]
+		n.exts = append([]string{e.sym}, n.exts...)
+
+	case typeUClass:
+		n = f.kids[1]
+		n.class = e.sym
+	}
+
+	p := &t.frames[len(t.frames)-1]
+	p.kids = append(p.kids, n)
+	return nil
+}
+
+// nodeVars pairs up the nodes of a list of symbol => value pairs.
+func nodeVars(kids []*node) []nodeVar {
+	var vars []nodeVar
+	for i := 0; i+1 < len(kids); i += 2 {
+		vars = append(vars, nodeVar{string(kids[i].data), kids[i+1]})
+	}
+	return vars
+}
+
+// bignumString formats the little endian magnitude of a Bignum in decimal.
+func bignumString(neg bool, data []byte) string {
+	b := make([]byte, len(data))
+	for i, c := range data {
+		b[len(b)-1-i] = c
+	}
+	i := new(big.Int).SetBytes(b)
+	if neg {
+		i.Neg(i)
+	}
+	return i.String()
+}
@@ -0,0 +1,128 @@
+package rmarsh
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+)
+
+// ErrDisallowedClass is the class of error returned when a Marshal stream references a class or module that the
+// AllowClass limit rejects. A ClassError describing the class can be matched against it with errors.Is.
+var ErrDisallowedClass = fmt.Errorf("Class not allowed")
+
+// A ClassError is returned by Validate when a Marshal stream references a class or module that AllowClass rejects.
+type ClassError struct {
+	Class  string // Name of the class or module.
+	Offset int    // Offset in the stream of the value that references it.
+}
+
+func (e ClassError) Error() string {
+	return fmt.Sprintf("Marshal stream references disallowed class %s", e.Class)
+}
+
+// Is reports whether target is ErrDisallowedClass.
+func (e ClassError) Is(target error) bool {
+	return target == ErrDisallowedClass
+}
+
+// FindingKind classifies a structural problem discovered by Validate.
+type FindingKind uint8
+
+// The kinds of problems Validate can report.
+const (
+	FindingBadMagic FindingKind = iota + 1
+	FindingTruncated
+	FindingUnknownType
+	FindingBadLength
+	FindingBadLink
+	FindingBadSymlink
+	FindingNonSymbol
+	FindingInvalidUTF8
+	FindingLimitExceeded
+	FindingDisallowedClass
+)
+
+var findingKindNames = map[FindingKind]string{
+	FindingBadMagic:        "bad_magic",
+	FindingTruncated:       "truncated",
+	FindingUnknownType:     "unknown_type",
+	FindingBadLength:       "bad_length",
+	FindingBadLink:         "bad_link",
+	FindingBadSymlink:      "bad_symlink",
+	FindingNonSymbol:       "non_symbol",
+	FindingInvalidUTF8:     "invalid_utf8",
+	FindingLimitExceeded:   "limit_exceeded",
+	FindingDisallowedClass: "disallowed_class",
+}
+
+func (k FindingKind) String() string {
+	if n, ok := findingKindNames[k]; ok {
+		return n
+	}
+	return "unknown"
+}
+
+// MarshalText renders the kind by name, so findings serialize to readable JSON.
+func (k FindingKind) MarshalText() ([]byte, error) {
+	return []byte(k.String()), nil
+}
+
+// A Finding describes a single structural problem in a Marshal stream, and the byte offset it was found at.
+type Finding struct {
+	Offset int         `json:"offset"`
+	Kind   FindingKind `json:"kind"`
+	Msg    string      `json:"msg"`
+}
+
+func (f Finding) String() string {
+	return fmt.Sprintf("%d: %s: %s", f.Offset, f.Kind, f.Msg)
+}
+
+// ValidateLimits bounds the work Validate will do on a stream. A zero value for any field means no limit, except for
+// MaxDepth, which is never more than 10000.
+type ValidateLimits struct {
+	MaxDepth   int // Maximum nesting depth of arrays, hashes, objects, ivars, etc.
+	MaxLength  int // Maximum declared length of any string, symbol, array, hash or object.
+	MaxSize    int // Maximum number of bytes to read from the stream.
+	MaxSymbols int // Maximum number of distinct symbols the stream may define.
+	MaxLinks   int // Maximum number of linkable objects the stream may contain.
+
+	// AllowClass, if set, is consulted for the name of every class and module referenced by the stream: the classes of
+	// objects, structs, user defined and user marshalled types, user subclasses of core types, modules that extend
+	// objects, and plain Class/Module values. The first name it returns false for ends the scan with a disallowed class
+	// finding and a ClassError. This allows untrusted payloads to be vetted before they're handed to Ruby, in the spirit
+	// of a safe_load.
+	// The allowlist only applies to Validate. It has no effect on the Parser, which doesn't read class names at all, nor
+	// on NewIndex, WriteRuby, Hash and the other utilities that read whole streams, which accept any class. Validate
+	// a payload with the allowlist first if it needs vetting before it's used with those.
+	AllowClass func(name string) bool
+}
+
+// A ValidationReport is the result of validating a Marshal stream.
+type ValidationReport struct {
+	Size     int       `json:"size"`     // The number of bytes that were examined.
+	Findings []Finding `json:"findings"` // Problems found, in stream order.
+}
+
+// Valid returns true if no problems were found in the stream.
+func (r *ValidationReport) Valid() bool {
+	return len(r.Findings) == 0
+}
+
+// Validate scans a single Marshal stream from the provided io.Reader and reports any structural problems it contains:
+// truncation, unknown type tags, invalid lengths, dangling object links and symlinks, and strings that claim to be
+// UTF-8 but aren't. Some problems (such as a bad link id) do not prevent the rest of the stream from being checked,
+// whereas others (such as truncation or an unknown type) end the scan.
+// Unlike the Parser, Validate understands every type in the Marshal 4.8 format, and so can be used to bulk check
+// payloads from cache and session stores for corruption. Validate buffers reads from r, so it may consume bytes past the
+// end of the Marshal stream.
+// The returned error is a ClassError if the stream references a class that limits.AllowClass rejects. Otherwise it's
+// only non-nil if reading from r failed with something other than io.EOF.
+func Validate(r io.Reader, limits ValidateLimits) (*ValidationReport, error) {
+	s := scanner{r: bufio.NewReader(r), limits: limits}
+	err := s.stream()
+	if err == errScanStop {
+		err = s.classErr
+	}
+	return &s.report, err
+}
@@ -0,0 +1,198 @@
+package rmarsh_test
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"testing"
+
+	"github.com/samcday/rmarsh"
+)
+
+// Generates a stream that exercises most of the Marshal grammar.
+func genValidateStream(t testing.TB, str string) []byte {
+	return genStream(t, func(gen *rmarsh.Generator) error {
+		if err := gen.StartArray(6); err != nil {
+			return err
+		}
+		if err := gen.Fixnum(0xDEADBEEF); err != nil {
+			return err
+		}
+		if err := gen.Symbol("test"); err != nil {
+			return err
+		}
+		if err := gen.Symbol("test"); err != nil {
+			return err
+		}
+		if err := gen.StartIVar(1); err != nil {
+			return err
+		}
+		if err := gen.String(str); err != nil {
+			return err
+		}
+		if err := gen.Symbol("E"); err != nil {
+			return err
+		}
+		if err := gen.Bool(true); err != nil {
+			return err
+		}
+		if err := gen.EndIVar(); err != nil {
+			return err
+		}
+		if err := gen.StartObject("Foo", 1); err != nil {
+			return err
+		}
+		if err := gen.Symbol("@bar"); err != nil {
+			return err
+		}
+		if err := gen.Float(1.5); err != nil {
+			return err
+		}
+		if err := gen.EndObject(); err != nil {
+			return err
+		}
+		if err := gen.UserDefinedObject("UsrDef", "data"); err != nil {
+			return err
+		}
+		return gen.EndArray()
+	})
+}
+
+func expectFinding(t *testing.T, raw []byte, limits rmarsh.ValidateLimits, kind rmarsh.FindingKind, off int) {
+	report, err := rmarsh.Validate(bytes.NewReader(raw), limits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Findings) != 1 {
+		t.Fatalf("Expected 1 finding for %x, got %v", raw, report.Findings)
+	}
+	if f := report.Findings[0]; f.Kind != kind || f.Offset != off {
+		t.Fatalf("Finding %s is not expected %s at offset %d", f, kind, off)
+	}
+}
+
+func TestValidateValid(t *testing.T) {
+	raw := genValidateStream(t, "héllo")
+	report, err := rmarsh.Validate(bytes.NewReader(raw), rmarsh.ValidateLimits{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Valid() {
+		t.Fatalf("Unexpected findings %v", report.Findings)
+	}
+	if report.Size != len(raw) {
+		t.Fatalf("report.Size %d != %d", report.Size, len(raw))
+	}
+}
+
+func TestValidateTruncated(t *testing.T) {
+	raw := genValidateStream(t, "héllo")
+	for i := 0; i < len(raw); i++ {
+		expectFinding(t, raw[:i], rmarsh.ValidateLimits{}, rmarsh.FindingTruncated, i)
+	}
+}
+
+func TestValidateInvalidUTF8(t *testing.T) {
+	raw := genValidateStream(t, "\xFFbad")
+	report, err := rmarsh.Validate(bytes.NewReader(raw), rmarsh.ValidateLimits{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Findings) != 1 || report.Findings[0].Kind != rmarsh.FindingInvalidUTF8 {
+		t.Fatalf("Unexpected findings %v", report.Findings)
+	}
+}
+
+func TestValidateBadMagic(t *testing.T) {
+	expectFinding(t, []byte{0x04, 0x07, '0'}, rmarsh.ValidateLimits{}, rmarsh.FindingBadMagic, 0)
+}
+
+func TestValidateUnknownType(t *testing.T) {
+	expectFinding(t, []byte{0x04, 0x08, '[', 0x06, 'X'}, rmarsh.ValidateLimits{}, rmarsh.FindingUnknownType, 4)
+}
+
+func TestValidateBadLink(t *testing.T) {
+	// [@1, nil] - only the array itself (id 0) is linkable.
+	expectFinding(t, []byte{0x04, 0x08, '[', 0x07, '@', 0x06, '0'}, rmarsh.ValidateLimits{}, rmarsh.FindingBadLink, 4)
+}
+
+func TestValidateBadSymlink(t *testing.T) {
+	expectFinding(t, []byte{0x04, 0x08, ';', 0x00}, rmarsh.ValidateLimits{}, rmarsh.FindingBadSymlink, 2)
+}
+
+func TestValidateBadLength(t *testing.T) {
+	expectFinding(t, []byte{0x04, 0x08, '"', 0xFA}, rmarsh.ValidateLimits{}, rmarsh.FindingBadLength, 3)
+}
+
+func TestValidateNonSymbol(t *testing.T) {
+	expectFinding(t, []byte{0x04, 0x08, 'o', '0'}, rmarsh.ValidateLimits{}, rmarsh.FindingNonSymbol, 3)
+}
+
+func TestValidateLimits(t *testing.T) {
+	expectFinding(t, []byte{0x04, 0x08, '[', 0x06, '[', 0x06, '[', 0x00}, rmarsh.ValidateLimits{MaxDepth: 2}, rmarsh.FindingLimitExceeded, 6)
+	expectFinding(t, []byte{0x04, 0x08, '[', 0x08, '0', '0', '0'}, rmarsh.ValidateLimits{MaxLength: 2}, rmarsh.FindingLimitExceeded, 3)
+	expectFinding(t, []byte{0x04, 0x08, '[', 0x08, '0', '0', '0'}, rmarsh.ValidateLimits{MaxSize: 5}, rmarsh.FindingLimitExceeded, 5)
+	expectFinding(t, []byte{0x04, 0x08, '[', 0x07, ':', 0x06, 'a', ':', 0x06, 'b'}, rmarsh.ValidateLimits{MaxSymbols: 1}, rmarsh.FindingLimitExceeded, 7)
+	expectFinding(t, []byte{0x04, 0x08, '[', 0x07, '"', 0x06, 'x', '"', 0x06, 'y'}, rmarsh.ValidateLimits{MaxLinks: 2}, rmarsh.FindingLimitExceeded, 7)
+}
+
+// Hostile input nested far deeper than any real payload is rejected even when no MaxDepth is set.
+func TestValidateDepthCap(t *testing.T) {
+	raw := append([]byte{0x04, 0x08}, bytes.Repeat([]byte{'[', 0x06}, 20000)...)
+	raw = append(raw, '0')
+	expectFinding(t, raw, rmarsh.ValidateLimits{}, rmarsh.FindingLimitExceeded, 20002)
+	expectFinding(t, raw, rmarsh.ValidateLimits{MaxDepth: 50000}, rmarsh.FindingLimitExceeded, 20002)
+
+	if err := rmarsh.WriteRuby(ioutil.Discard, bytes.NewReader(raw)); err == nil {
+		t.Error("WriteRuby: expected error")
+	}
+	if err := rmarsh.DumpTokens(ioutil.Discard, bytes.NewReader(raw)); err == nil {
+		t.Error("DumpTokens: expected error")
+	}
+}
+
+func TestValidateAllowClass(t *testing.T) {
+	raw := genValidateStream(t, "héllo")
+	allowed := map[string]bool{"Foo": true}
+	limits := rmarsh.ValidateLimits{AllowClass: func(name string) bool { return allowed[name] }}
+	report, err := rmarsh.Validate(bytes.NewReader(raw), limits)
+	if cerr, ok := err.(rmarsh.ClassError); !ok || cerr.Class != "UsrDef" || !errors.Is(err, rmarsh.ErrDisallowedClass) {
+		t.Fatalf("Unexpected error %+v", err)
+	}
+	if len(report.Findings) != 1 || report.Findings[0].Kind != rmarsh.FindingDisallowedClass {
+		t.Fatalf("Unexpected findings %v", report.Findings)
+	}
+	if f := report.Findings[0]; f.Offset != err.(rmarsh.ClassError).Offset {
+		t.Errorf("Finding %s is not at the offset of %+v", f, err)
+	}
+
+	allowed["UsrDef"] = true
+	if report, err = rmarsh.Validate(bytes.NewReader(raw), limits); err != nil {
+		t.Fatal(err)
+	}
+	if !report.Valid() {
+		t.Fatalf("Unexpected findings %v", report.Findings)
+	}
+
+	// Scanning stops at the first disallowed class.
+	raw = []byte{0x04, 0x08, '[', 0x07, 'c', 0x08, 'F', 'o', 'o', 'c', 0x08, 'B', 'a', 'r'}
+	report, err = rmarsh.Validate(bytes.NewReader(raw), rmarsh.ValidateLimits{AllowClass: func(string) bool { return false }})
+	if cerr, ok := err.(rmarsh.ClassError); !ok || cerr.Class != "Foo" || cerr.Offset != 4 {
+		t.Fatalf("Unexpected error %+v", err)
+	}
+	if len(report.Findings) != 1 || report.Size != 9 {
+		t.Fatalf("Unexpected report %+v", report)
+	}
+}
+
+func BenchmarkValidate(b *testing.B) {
+	raw := genValidateStream(b, "héllo")
+	r := bytes.NewReader(raw)
+
+	for i := 0; i < b.N; i++ {
+		r.Reset(raw)
+		if _, err := rmarsh.Validate(r, rmarsh.ValidateLimits{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}